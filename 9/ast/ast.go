@@ -3,9 +3,9 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
 	"malang/token"
 	"strings"
-	"fmt"
 )
 
 // 每个节点都需要实现Node接口
@@ -13,6 +13,8 @@ type Node interface {
 	// 返回与该节点关联的字面量(该方法仅用于调试和测试)
 	TokenLiteral() string
 	String() string
+	// 节点在源码中的起始位置
+	Pos() token.Position
 }
 type Statement interface {
 	Node
@@ -39,6 +41,13 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+
 func (p *Program) TokenLiteral() string {
 	if len(p.Statements) > 0 {
 		return p.Statements[0].TokenLiteral()
@@ -56,23 +65,29 @@ type Identifier struct {
 func (i *Identifier) expressionNode() {}
 
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() token.Position  { return i.Token.Pos }
 
 func (i *Identifier) String() string { return i.Value }
 
 // let语句
 type LetStatement struct {
-	Token token.Token // token.LET词法单元
-	Name  *Identifier // 标识符
-	Value Expression  // 产生值的表达式
+	Token    token.Token // token.LET词法单元
+	Name     *Identifier // 标识符
+	Value    Expression  // 产生值的表达式
+	Exported bool        // export let,模块导出的绑定
 }
 
 func (ls *LetStatement) statementNode() {}
 
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *LetStatement) Pos() token.Position  { return ls.Token.Pos }
 
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
+	if ls.Exported {
+		out.WriteString("export ")
+	}
 	out.WriteString(ls.TokenLiteral() + " ")
 	out.WriteString(ls.Name.String())
 	out.WriteString(" = ")
@@ -93,6 +108,7 @@ type ReturnStatement struct {
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() token.Position  { return rs.Token.Pos }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -115,6 +131,7 @@ type ExpressionStatement struct {
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() token.Position  { return es.Token.Pos }
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -130,8 +147,20 @@ type IntegerLiteral struct {
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() token.Position  { return il.Token.Pos }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
+// 浮点数字面量
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() token.Position  { return fl.Token.Pos }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+
 type PrefixExpression struct {
 	Token    token.Token // 前缀词法单元 - !
 	Operator string      // 包含-或!的字符串
@@ -140,6 +169,7 @@ type PrefixExpression struct {
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Pos }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 
@@ -161,6 +191,12 @@ type InfixExpression struct {
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() token.Position {
+	if ie.Left != nil {
+		return ie.Left.Pos()
+	}
+	return ie.Token.Pos
+}
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 
@@ -173,6 +209,34 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 
+// 赋值表达式 x = 1, x += 1
+type AssignExpression struct {
+	Token    token.Token // 赋值运算符词法单元,如=或+=
+	Target   Expression  // 被赋值的目标
+	Operator string
+	Value    Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) Pos() token.Position {
+	if ae.Target != nil {
+		return ae.Target.Pos()
+	}
+	return ae.Token.Pos
+}
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ae.Target.String())
+	out.WriteString(" " + ae.Operator + " ")
+	out.WriteString(ae.Value.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
 type Boolean struct {
 	Token token.Token
 	Value bool
@@ -180,6 +244,7 @@ type Boolean struct {
 
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Pos }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
 type BlockStatement struct {
@@ -189,6 +254,7 @@ type BlockStatement struct {
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() token.Position  { return bs.Token.Pos }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -208,6 +274,7 @@ type IfExpression struct {
 
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 
@@ -233,6 +300,7 @@ type FunctionLiteral struct {
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Pos }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
@@ -261,6 +329,12 @@ type CallExpression struct {
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position {
+	if ce.Function != nil {
+		return ce.Function.Pos()
+	}
+	return ce.Token.Pos
+}
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 
@@ -272,7 +346,7 @@ func (ce *CallExpression) String() string {
 	out.WriteString((ce.Function.String()))
 	out.WriteString("(")
 	out.WriteString(strings.Join(args, ", "))
-	out.WriteString(") ")
+	out.WriteString(")")
 
 	return out.String()
 }
@@ -284,6 +358,7 @@ type StringLiteral struct {
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Position  { return sl.Token.Pos }
 func (sl *StringLiteral) String() string       { return sl.Token.Literal }
 
 type ArrayLiteral struct {
@@ -293,6 +368,7 @@ type ArrayLiteral struct {
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() token.Position  { return al.Token.Pos }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 
@@ -316,6 +392,12 @@ type IndexExpression struct {
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Position {
+	if ie.Left != nil {
+		return ie.Left.Pos()
+	}
+	return ie.Token.Pos
+}
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 
@@ -331,11 +413,18 @@ func (ie *IndexExpression) String() string {
 type UseExpression struct {
 	Token    token.Token // 'use'词法单元
 	FileName string      // 导入的文件名
+	Name     string      // 绑定模块对象的名字(use foo as f 中的f,默认为foo),模块名不是标识符时为空
 }
 
 func (ue *UseExpression) expressionNode()      {}
 func (ue *UseExpression) TokenLiteral() string { return ue.Token.Literal }
-func (ue *UseExpression) String() string       { return ue.FileName }
+func (ue *UseExpression) Pos() token.Position  { return ue.Token.Pos }
+func (ue *UseExpression) String() string {
+	if ue.Name == "" {
+		return "use " + ue.FileName
+	}
+	return "use " + ue.FileName + " as " + ue.Name
+}
 
 type HashLiteral struct {
 	Token token.Token // '{'词法单元
@@ -344,6 +433,7 @@ type HashLiteral struct {
 
 func (hl *HashLiteral) expressionNode()      {}
 func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Position  { return hl.Token.Pos }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
@@ -367,6 +457,7 @@ type ForExpression struct {
 
 func (fl *ForExpression) expressionNode()      {}
 func (fl *ForExpression) TokenLiteral() string { return fl.Token.Literal }
+func (fl *ForExpression) Pos() token.Position  { return fl.Token.Pos }
 func (fl *ForExpression) String() string {
 	var out bytes.Buffer
 
@@ -384,6 +475,7 @@ type BreakExpression struct {
 
 func (bs *BreakExpression) expressionNode()      {}
 func (bs *BreakExpression) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakExpression) Pos() token.Position  { return bs.Token.Pos }
 func (bs *BreakExpression) String() string {
 	var out bytes.Buffer
 
@@ -399,6 +491,7 @@ type ContinueExpression struct {
 
 func (cs *ContinueExpression) expressionNode()      {}
 func (cs *ContinueExpression) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueExpression) Pos() token.Position  { return cs.Token.Pos }
 func (cs *ContinueExpression) String() string {
 	var out bytes.Buffer
 
@@ -407,3 +500,49 @@ func (cs *ContinueExpression) String() string {
 
 	return out.String()
 }
+
+// try { } catch (e) { } finally { },catch和finally至少有一个
+type TryExpression struct {
+	Token   token.Token     // 'try'词法单元
+	Block   *BlockStatement // 受保护的代码
+	Param   *Identifier     // 绑定异常值的变量,可以省略
+	Catch   *BlockStatement // 可以为nil
+	Finally *BlockStatement // 可以为nil
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) Pos() token.Position  { return te.Token.Pos }
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("try ")
+	out.WriteString(te.Block.String())
+
+	if te.Catch != nil {
+		out.WriteString(" catch ")
+		if te.Param != nil {
+			out.WriteString("(" + te.Param.String() + ") ")
+		}
+		out.WriteString(te.Catch.String())
+	}
+	if te.Finally != nil {
+		out.WriteString(" finally ")
+		out.WriteString(te.Finally.String())
+	}
+
+	return out.String()
+}
+
+// throw语句
+type ThrowStatement struct {
+	Token token.Token // 'throw'词法单元
+	Value Expression  // 抛出的值
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) Pos() token.Position  { return ts.Token.Pos }
+func (ts *ThrowStatement) String() string {
+	return "throw " + ts.Value.String() + ";"
+}
@@ -5,41 +5,61 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"malang/token"
+	"sort"
 )
 
 // 操作码定义
 const (
-	OpConstant Opcode = iota
-	OpAdd             // +
-	OpSub             // -
-	OpMul             // *
-	OpDiv             // /
+	OpConstant   Opcode = iota
+	OpAdd               // +
+	OpSub               // -
+	OpMul               // *
+	OpDiv               // /
+	OpMod               // %
+	OpBitAnd            // &
+	OpBitOr             // |
+	OpBitXor            // ^
+	OpShiftLeft         // <<
+	OpShiftRight        // >>
 	OpPop
 	OpTrue
 	OpFalse
 	OpEqual
 	OpNotEqual
 	OpGreaterThan
-	OpMinus          // - 负号
-	OpBang           // !
-	OpJumpNotTruthy  // 有条件跳转
-	OpJump           // 无条件跳转
-	OpNull           // 将Null压栈
-	OpGetGlobal      // 从全局存储中取值
-	OpSetGlobal      // 向全局存储中存值
-	OpArray          // 构建数组
-	OpHash           // 构建哈希
-	OpIndex          // 索引运算
-	OpCall           // 调用函数
-	OpReturnValue    // 函数返回
-	OpReturn         // 函数没有返回值
-	OpFor            // for循环起始处
-	OpGetLocal       // 局部绑定get
-	OpSetLocal       // 局部绑定set
-	OpGetBuiltin     // 获取内置函数
-	OpClosure        // 闭包
-	OpGetFree        // 获取自由变量
-	OpCurrentClosure // 加载正在执行的闭包
+	OpGreaterThanOrEqual // >=
+	OpLessThanOrEqual    // <=
+	OpMinus              // - 负号
+	OpBang               // !
+	OpJumpNotTruthy      // 有条件跳转
+	OpJump               // 无条件跳转
+	OpNull               // 将Null压栈
+	OpGetGlobal          // 从全局存储中取值
+	OpSetGlobal          // 向全局存储中存值
+	OpArray              // 构建数组
+	OpHash               // 构建哈希
+	OpIndex              // 索引运算
+	OpCall               // 调用函数
+	OpReturnValue        // 函数返回
+	OpReturn             // 函数没有返回值
+	OpGetLocal           // 局部绑定get
+	OpSetLocal           // 局部绑定set
+	OpGetBuiltin         // 获取内置函数
+	OpClosure            // 闭包
+	OpGetFree            // 获取自由变量
+	OpCurrentClosure     // 加载正在执行的闭包
+	OpSetFree            // 修改自由变量
+	OpCaptureLocal       // 捕获局部绑定(装箱为Cell)
+	OpCaptureFree        // 捕获外层闭包的自由变量Cell
+	OpSetIndex           // 索引赋值
+	OpDup2               // 复制栈顶两个元素
+	OpLoadModule         // 加载模块(只执行一次)
+	OpTry                // 登记异常处理器,操作数是catch的位置
+	OpEndTry             // 注销最近登记的异常处理器
+	OpThrow              // 抛出栈顶的值
+	OpTailCall           // 尾调用,复用当前栈帧
+	OpLessThan           // 小于,追加在末尾保持已有操作码的编号不变
 )
 
 type Instructions []byte
@@ -54,19 +74,27 @@ type Definition struct {
 
 // 操作码定义详细信息
 var definitions = map[Opcode]*Definition{
-	OpConstant:    {"OpConstant", []int{2}},
-	OpAdd:         {"OpAdd", []int{}},
-	OpSub:         {"OpSub", []int{}},
-	OpMul:         {"OpMul", []int{}},
-	OpDiv:         {"OpDiv", []int{}},
-	OpPop:         {"OpPop", []int{}},
-	OpTrue:        {"OpTrue", []int{}},
-	OpFalse:       {"OpFalse", []int{}},
-	OpEqual:       {"OpEqual", []int{}},
-	OpNotEqual:    {"OpNotEqual", []int{}},
-	OpGreaterThan: {"OpGreaterThan", []int{}},
-	OpMinus:       {"OpMinus", []int{}},
-	OpBang:        {"OpBang", []int{}},
+	OpConstant:           {"OpConstant", []int{2}},
+	OpAdd:                {"OpAdd", []int{}},
+	OpSub:                {"OpSub", []int{}},
+	OpMul:                {"OpMul", []int{}},
+	OpDiv:                {"OpDiv", []int{}},
+	OpMod:                {"OpMod", []int{}},
+	OpBitAnd:             {"OpBitAnd", []int{}},
+	OpBitOr:              {"OpBitOr", []int{}},
+	OpBitXor:             {"OpBitXor", []int{}},
+	OpShiftLeft:          {"OpShiftLeft", []int{}},
+	OpShiftRight:         {"OpShiftRight", []int{}},
+	OpPop:                {"OpPop", []int{}},
+	OpTrue:               {"OpTrue", []int{}},
+	OpFalse:              {"OpFalse", []int{}},
+	OpEqual:              {"OpEqual", []int{}},
+	OpNotEqual:           {"OpNotEqual", []int{}},
+	OpGreaterThan:        {"OpGreaterThan", []int{}},
+	OpGreaterThanOrEqual: {"OpGreaterThanOrEqual", []int{}},
+	OpLessThanOrEqual:    {"OpLessThanOrEqual", []int{}},
+	OpMinus:              {"OpMinus", []int{}},
+	OpBang:               {"OpBang", []int{}},
 	// 跳转指令有两字节大小（16位）的操作数（目标指令的绝对偏移量）
 	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}},
 	OpJump:           {"OpJump", []int{2}},
@@ -79,13 +107,23 @@ var definitions = map[Opcode]*Definition{
 	OpCall:           {"OpCall", []int{1}},
 	OpReturnValue:    {"OpReturnValue", []int{}},
 	OpReturn:         {"OpReturn", []int{}},
-	OpFor:            {"OpFor", []int{}},
 	OpGetLocal:       {"OpGetLocal", []int{1}},
 	OpSetLocal:       {"OpSetLocal", []int{1}},
 	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
 	OpClosure:        {"OpClosure", []int{2, 1}},
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpSetFree:        {"OpSetFree", []int{1}},
+	OpCaptureLocal:   {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:    {"OpCaptureFree", []int{1}},
+	OpSetIndex:       {"OpSetIndex", []int{}},
+	OpDup2:           {"OpDup2", []int{}},
+	OpLoadModule:     {"OpLoadModule", []int{2}},
+	OpTry:            {"OpTry", []int{2}},
+	OpEndTry:         {"OpEndTry", []int{}},
+	OpThrow:          {"OpThrow", []int{}},
+	OpTailCall:       {"OpTailCall", []int{1}},
+	OpLessThan:       {"OpLessThan", []int{}},
 }
 
 // 查看操作码定义
@@ -144,9 +182,15 @@ func (ins Instructions) String() string {
 	for i < len(ins) {
 		def, err := Lookup(ins[i])
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			// 跳过无法识别的字节,继续解码后面的指令
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			i++
 			continue
 		}
+		if !def.Fits(ins[i+1:]) {
+			fmt.Fprintf(&out, "%04d ERROR: truncated %s\n", i, def.Name)
+			break
+		}
 
 		// 读取操作数，read是读取了多少字节
 		operands, read := ReadOperands(def, ins[i+1:])
@@ -179,6 +223,15 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
 
+// ins中是否有完整的操作数
+func (def *Definition) Fits(ins Instructions) bool {
+	width := 0
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	return width <= len(ins)
+}
+
 // 逆make
 // 反编码make编码后的操作数
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
@@ -206,3 +259,47 @@ func ReadUint16(ins Instructions) uint16 {
 func ReadUint8(ins Instructions) uint8 {
 	return uint8(ins[0])
 }
+
+// 源码映射中的一项: 从Offset开始的指令都由Pos处的源码编译而来
+type SourceMapping struct {
+	Offset int
+	Pos    token.Position
+}
+
+// 指令偏移量到源码位置的映射表,按Offset升序排列
+type SourceMap []SourceMapping
+
+// 记录从offset开始的指令对应的源码位置,与上一项位置相同时不重复记录
+func (sm SourceMap) Add(offset int, pos token.Position) SourceMap {
+	if !pos.IsValid() {
+		return sm
+	}
+	if len(sm) > 0 {
+		last := sm[len(sm)-1]
+		if last.Pos == pos {
+			return sm
+		}
+		// 同一偏移量重复记录时以最后一次为准
+		if last.Offset == offset {
+			sm[len(sm)-1].Pos = pos
+			return sm
+		}
+	}
+	return append(sm, SourceMapping{Offset: offset, Pos: pos})
+}
+
+// 去掉偏移量在offset及之后的映射(指令被截断时使用)
+func (sm SourceMap) Truncate(offset int) SourceMap {
+	i := sort.Search(len(sm), func(i int) bool { return sm[i].Offset >= offset })
+	return sm[:i]
+}
+
+// 查找偏移量offset处的指令对应的源码位置
+func (sm SourceMap) Lookup(offset int) (token.Position, bool) {
+	// 找到第一个Offset大于offset的项,它的前一项就是结果
+	i := sort.Search(len(sm), func(i int) bool { return sm[i].Offset > offset })
+	if i == 0 {
+		return token.Position{}, false
+	}
+	return sm[i-1].Pos, true
+}
@@ -1,6 +1,9 @@
 package code
 
-import "testing"
+import (
+	"malang/token"
+	"testing"
+)
 
 func TestMake(t *testing.T) {
 	ts := []struct {
@@ -90,6 +93,23 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringErrors(t *testing.T) {
+	ts := []struct {
+		ins      Instructions
+		expected string
+	}{
+		// 无法识别的操作码不能导致死循环
+		{Instructions{255, byte(OpPop)}, "0000 ERROR: opcode 255 undefined\n0001 OpPop\n"},
+		{append(Make(OpPop), byte(OpConstant), 1), "0000 OpPop\n0001 ERROR: truncated OpConstant\n"},
+	}
+
+	for _, tt := range ts {
+		if tt.ins.String() != tt.expected {
+			t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", tt.expected, tt.ins.String())
+		}
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	ts := []struct {
 		op        Opcode
@@ -119,3 +139,51 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceMap(t *testing.T) {
+	line := func(n int) token.Position {
+		return token.Position{File: "test.mal", Line: n, Column: 1}
+	}
+
+	var sm SourceMap
+	sm = sm.Add(0, line(1))
+	sm = sm.Add(3, line(1)) // 与上一项相同,不重复记录
+	sm = sm.Add(4, line(2))
+	sm = sm.Add(7, token.Position{}) // 无效位置不记录
+	sm = sm.Add(9, line(3))
+
+	if len(sm) != 3 {
+		t.Fatalf("wrong number of mappings. want=3, got=%d (%+v)", len(sm), sm)
+	}
+
+	ts := []struct {
+		offset   int
+		expected int
+	}{
+		{0, 1},
+		{3, 1},
+		{4, 2},
+		{8, 2},
+		{9, 3},
+		{100, 3},
+	}
+
+	for _, tt := range ts {
+		pos, ok := sm.Lookup(tt.offset)
+		if !ok {
+			t.Fatalf("no position for offset %d", tt.offset)
+		}
+		if pos.Line != tt.expected {
+			t.Errorf("wrong line for offset %d. want=%d, got=%d", tt.offset, tt.expected, pos.Line)
+		}
+	}
+
+	sm = sm.Truncate(4)
+	if len(sm) != 1 {
+		t.Fatalf("wrong number of mappings after truncate. want=1, got=%d", len(sm))
+	}
+
+	if _, ok := SourceMap(nil).Lookup(0); ok {
+		t.Errorf("empty source map should not resolve any offset")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"malang/ast"
 	"malang/code"
+	"malang/module"
 	"malang/object"
+	"malang/token"
+	"path/filepath"
 	"sort"
 )
 
@@ -13,15 +16,46 @@ type EmittedInstruction struct {
 	Position int
 }
 
+// 全局槽位的上限,OpGetGlobal和OpSetGlobal的操作数是两个字节
+const MaxGlobals = 1 << 16
+
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	SourceMap    code.SourceMap // 主程序指令的源码映射
+	NumGlobals   int            // 需要的全局槽位数
+}
+
+// 循环上下文,记录continue的跳转目标和待回填的break跳转
+type LoopContext struct {
+	start  int   // 循环条件的起始位置(continue跳转到这里)
+	depth  int   // 进入循环时的栈深度
+	breaks []int // break发出的OpJump的位置,循环编译完后回填
+}
+
+// try上下文(登记了异常处理器的区域),return、break和continue跳出时需要注销处理器并执行finally
+type TryContext struct {
+	loopDepth int                 // 进入try时所在的循环层数
+	finally   *ast.BlockStatement // 可以为nil
 }
 
 type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	// 循环上下文栈,每个函数作用域独立
+	loops []*LoopContext
+
+	// try上下文栈,每个函数作用域独立
+	tries []*TryContext
+
+	// 指令偏移量到源码位置的映射
+	sourceMap code.SourceMap
+
+	// 按顺序执行到当前位置时的栈深度,不包括局部变量
+	// break和continue可以出现在表达式中间,跳转前要弹出多出来的操作数
+	depth int
 }
 
 type Compiler struct {
@@ -34,6 +68,16 @@ type Compiler struct {
 	// 作用域
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// 正在编译的节点的源码位置,发出的指令都记录到该位置
+	pos token.Position
+
+	// 模块加载器,已编译模块在常量池中的索引记录在符号表中
+	modules *module.Loader
+
+	// 是否优化,以及去重用的常量索引
+	optimize      bool
+	constantIndex map[constantKey]int
 }
 
 func New() *Compiler {
@@ -44,25 +88,59 @@ func New() *Compiler {
 	}
 
 	symbolTable := NewSymbolTable()
-
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
-	}
+	symbolTable.DefineBuiltins(object.NewRegistry())
 
 	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: symbolTable,
-		scopes:      []CompilationScope{mainScope},
-		scopeIndex:  0,
+		constants:     []object.Object{},
+		symbolTable:   symbolTable,
+		scopes:        []CompilationScope{mainScope},
+		scopeIndex:    0,
+		modules:       module.NewLoader(nil),
+		optimize:      true,
+		constantIndex: make(map[constantKey]int),
 	}
 }
 
+// 设置use使用的模块加载器
+func (c *Compiler) SetModuleLoader(l *module.Loader) {
+	c.modules = l
+}
+
+// 设置内置函数注册表,需要在编译之前调用,执行时VM要使用同一个注册表
+func (c *Compiler) SetRegistry(r *object.Registry) {
+	c.symbolTable.DefineBuiltins(r)
+}
+
+// 设置是否优化生成的字节码,默认开启
+func (c *Compiler) SetOptimize(enabled bool) {
+	c.optimize = enabled
+}
+
 // 添加到常量池，返回常量池索引
+// 开启优化时相同的数字常量返回已有的索引
 func (c *Compiler) addConstant(obj object.Object) int {
+	key, ok := keyOf(obj)
+	if ok && c.optimize {
+		if i, ok := c.constantIndex[key]; ok {
+			return i
+		}
+	}
+
 	c.constants = append(c.constants, obj)
+	if ok {
+		c.constantIndex[key] = len(c.constants) - 1
+	}
 	return len(c.constants) - 1
 }
 
+// 开启优化时对编译完成的指令做跳转串联和死代码删除
+func (c *Compiler) optimizeScope(scope CompilationScope) (code.Instructions, code.SourceMap) {
+	if !c.optimize {
+		return scope.instructions, scope.sourceMap
+	}
+	return optimizeInstructions(scope.instructions, scope.sourceMap)
+}
+
 // 移除最后一条指令OpPop
 func (c *Compiler) removeLastPop() {
 	last := c.scopes[c.scopeIndex].lastInstruction
@@ -72,6 +150,8 @@ func (c *Compiler) removeLastPop() {
 	new := old[:last.Position]
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
+	c.scopes[c.scopeIndex].sourceMap = c.scopes[c.scopeIndex].sourceMap.Truncate(last.Position)
+	c.scopes[c.scopeIndex].depth++
 }
 
 // 判断if最后一个指令是不是OpPop
@@ -87,8 +167,50 @@ func (c *Compiler) replaceLastPopWithReturn() {
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
+// 把之后直接返回(中间只有无条件跳转)的OpCall换成OpTailCall
+// 两条指令长度相同,不影响跳转偏移量和源码映射
+// try中的return会先发出OpEndTry,因此try块中的调用不会被当作尾调用
+func markTailCalls(ins code.Instructions) {
+	for offset := 0; offset < len(ins); {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return
+		}
+		_, read := code.ReadOperands(def, ins[offset+1:])
+		next := offset + 1 + read
+
+		if code.Opcode(ins[offset]) == code.OpCall && returnsAt(ins, next) {
+			ins[offset] = byte(code.OpTailCall)
+		}
+		offset = next
+	}
+}
+
+// 从offset开始执行是否会直接返回栈顶的值
+func returnsAt(ins code.Instructions, offset int) bool {
+	// 最多跟随len(ins)次跳转,避免死循环的跳转环
+	for n := 0; n < len(ins) && offset < len(ins); n++ {
+		switch code.Opcode(ins[offset]) {
+		case code.OpReturnValue:
+			return true
+		case code.OpJump:
+			offset = int(code.ReadUint16(ins[offset+1:]))
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 // 遍历AST，触发指令
 func (c *Compiler) Compile(node ast.Node) error {
+	// 子节点编译完后恢复为当前节点的位置
+	if pos := node.Pos(); pos.IsValid() {
+		outer := c.pos
+		c.pos = pos
+		defer func() { c.pos = outer }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -104,18 +226,17 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpPop)
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
+		if c.optimize {
+			if obj, ok := constantValue(node); ok {
+				c.emitConstant(obj)
+				return nil
 			}
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
 		}
+
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
+		}
+
 		err := c.Compile(node.Left)
 		if err != nil {
 			return err
@@ -134,19 +255,40 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpShiftLeft)
+		case ">>":
+			c.emit(code.OpShiftRight)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
+		case ">=":
+			c.emit(code.OpGreaterThanOrEqual)
+		case "<=":
+			c.emit(code.OpLessThanOrEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return newError(node, "unknown operator %s", node.Operator)
 		}
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
 		// 发出OpConstant指令
 		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -154,6 +296,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpFalse)
 		}
 	case *ast.PrefixExpression:
+		if c.optimize {
+			if obj, ok := constantValue(node); ok {
+				c.emitConstant(obj)
+				return nil
+			}
+		}
+
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -165,7 +314,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "-":
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return newError(node, "unknown operator %s", node.Operator)
 		}
 	case *ast.IfExpression:
 		err := c.Compile(node.Condition)
@@ -175,41 +324,96 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		// 发出带虚假偏移量的OpJumpNotTruthy
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+		depth := c.depth()
 
-		err = c.Compile(node.Consequence)
+		// 结果部分以let等语句结尾时没有值,由compileBlockValue补一个Null保持栈平衡
+		err = c.compileBlockValue(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-
 		// 发出带有虚假偏移量的OpJump
 		jumpPos := c.emit(code.OpJump, 9999)
 
 		// 编译完结果部分和OpJump，就知道备选部分的第一条指令的位置
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		c.setDepth(depth)
 
 		if node.Alternative == nil {
 			// 备选部分为空则将Null压栈
 			c.emit(code.OpNull)
 		} else {
 			// 编译备选部分
-			err := c.Compile(node.Alternative)
+			err := c.compileBlockValue(node.Alternative)
 			if err != nil {
 				return err
 			}
-
-			// 去掉OpPop，保留fn内表达式值
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
+	case *ast.ForExpression:
+		loopStart := len(c.currentInstructions())
+		loopDepth := c.depth()
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		// 条件不成立时跳出循环,偏移量等循环体编译完再回填
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		c.enterLoop(loopStart, loopDepth)
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+		loop := c.leaveLoop()
+
+		// 回到条件处重新判断
+		c.emit(code.OpJump, loopStart)
+
+		afterBodyPos := len(c.currentInstructions())
+		c.changeOperand(jumpNotTruthyPos, afterBodyPos)
+		for _, pos := range loop.breaks {
+			c.changeOperand(pos, afterBodyPos)
+		}
+
+		// for表达式的值为Null
+		c.emit(code.OpNull)
+	case *ast.BreakExpression:
+		loop := c.currentLoop()
+		if loop == nil {
+			return newError(node, "break outside of loop")
+		}
+
+		depth := c.depth()
+		c.popTo(loop.depth)
+		err := c.exitTries(len(c.scopes[c.scopeIndex].loops))
+		if err != nil {
+			return err
+		}
+		pos := c.emit(code.OpJump, 9999)
+		loop.breaks = append(loop.breaks, pos)
+
+		// 之后的代码执行不到,当作break表达式压入了一个值继续编译
+		c.setDepth(depth + 1)
+	case *ast.ContinueExpression:
+		loop := c.currentLoop()
+		if loop == nil {
+			return newError(node, "continue outside of loop")
+		}
+
+		depth := c.depth()
+		c.popTo(loop.depth)
+		err := c.exitTries(len(c.scopes[c.scopeIndex].loops))
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loop.start)
+		c.setDepth(depth + 1)
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
 			err := c.Compile(s)
@@ -224,15 +428,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
-		}
+		c.storeSymbol(symbol)
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return newError(node, "undefined variable %s", node.Value)
 		}
 
 		c.loadSymbol(symbol)
@@ -274,7 +476,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpHash, len(node.Pairs)*2)
 	case *ast.IndexExpression:
-		err := c.Compile(node.Left)
+		err := c.checkModuleMember(node)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(node.Left)
 		if err != nil {
 			return err
 		}
@@ -310,27 +517,46 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		instructions, sourceMap := c.optimizeScope(c.scopes[c.scopeIndex])
+		markTailCalls(instructions)
+		c.leaveScope()
 
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
+			c.captureSymbol(s)
 		}
 
 		compiledFn := &object.CompiledFunction{
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			SourceMap:     sourceMap,
 		}
 
 		fnIndex := c.addConstant(compiledFn)
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	case *ast.UseExpression:
+		return c.compileUseExpression(node)
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
+		err = c.exitTries(0)
+		if err != nil {
+			return err
+		}
 		c.emit(code.OpReturnValue)
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpThrow)
 	case *ast.CallExpression:
 		err := c.Compile(node.Function)
 		if err != nil {
@@ -350,10 +576,66 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// 编译逻辑运算 && 和 ||
+// 通过条件跳转实现短路,结果总是布尔值
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	depth := c.depth()
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	// 左侧已经能决定结果时需要回填到OpFalse的跳转
+	jumpFalsePositions := []int{}
+	// 需要回填到表达式末尾的跳转
+	jumpEndPositions := []int{}
+
+	switch node.Operator {
+	case "&&":
+		// 左侧为假,直接得到false
+		jumpFalsePositions = append(jumpFalsePositions, c.emit(code.OpJumpNotTruthy, 9999))
+	case "||":
+		// 左侧为真,直接得到true,否则去计算右侧
+		jumpRightPos := c.emit(code.OpJumpNotTruthy, 9999)
+		c.emit(code.OpTrue)
+		jumpEndPositions = append(jumpEndPositions, c.emit(code.OpJump, 9999))
+		c.changeOperand(jumpRightPos, len(c.currentInstructions()))
+		c.setDepth(depth)
+	default:
+		return newError(node, "unknown operator %s", node.Operator)
+	}
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	// 由右侧的真值决定结果
+	jumpFalsePositions = append(jumpFalsePositions, c.emit(code.OpJumpNotTruthy, 9999))
+	c.emit(code.OpTrue)
+	jumpEndPositions = append(jumpEndPositions, c.emit(code.OpJump, 9999))
+
+	c.setDepth(depth)
+	falsePos := c.emit(code.OpFalse)
+	for _, pos := range jumpFalsePositions {
+		c.changeOperand(pos, falsePos)
+	}
+
+	afterPos := len(c.currentInstructions())
+	for _, pos := range jumpEndPositions {
+		c.changeOperand(pos, afterPos)
+	}
+
+	return nil
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions, sourceMap := c.optimizeScope(c.scopes[c.scopeIndex])
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
 		Constants:    c.constants,
+		SourceMap:    sourceMap,
+		NumGlobals:   c.symbolTable.NumGlobals(),
 	}
 }
 
@@ -362,12 +644,36 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
 
+	// 记录该指令对应的源码位置
+	sourceMap := c.scopes[c.scopeIndex].sourceMap
+	c.scopes[c.scopeIndex].sourceMap = sourceMap.Add(pos, c.pos)
+
 	// 记录最后两条指令
 	c.setLastInstruction(op, pos)
 
+	pop, push := stackEffect(instruction{op: op, operands: operands})
+	c.scopes[c.scopeIndex].depth += push - pop
+
 	return pos
 }
 
+// 当前的栈深度
+func (c *Compiler) depth() int {
+	return c.scopes[c.scopeIndex].depth
+}
+
+// 跳转目标处的栈深度由跳转来源决定,按顺序编译到这里时需要重新设置
+func (c *Compiler) setDepth(depth int) {
+	c.scopes[c.scopeIndex].depth = depth
+}
+
+// 弹出操作数直到栈深度为depth
+func (c *Compiler) popTo(depth int) {
+	for c.depth() > depth {
+		c.emit(code.OpPop)
+	}
+}
+
 // 将新生成的字节码指令添加到字节码
 func (c *Compiler) addInstruction(ins []byte) int {
 	posNewInstruction := len(c.currentInstructions())
@@ -411,6 +717,11 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	compiler := New()
 	compiler.symbolTable = s
 	compiler.constants = constants
+	for i, obj := range constants {
+		if key, ok := keyOf(obj); ok {
+			compiler.constantIndex[key] = i
+		}
+	}
 	return compiler
 }
 
@@ -444,6 +755,163 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+// 进入循环,depth为循环开始处的栈深度
+func (c *Compiler) enterLoop(start int, depth int) {
+	loops := c.scopes[c.scopeIndex].loops
+	c.scopes[c.scopeIndex].loops = append(loops, &LoopContext{start: start, depth: depth})
+}
+
+// 离开循环,返回该循环的上下文
+func (c *Compiler) leaveLoop() *LoopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	loop := loops[len(loops)-1]
+	c.scopes[c.scopeIndex].loops = loops[:len(loops)-1]
+	return loop
+}
+
+// 当前所在的最内层循环,不在循环内返回nil
+func (c *Compiler) currentLoop() *LoopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+// try表达式
+//
+//	OpTry catch
+//	<try块>        值留在栈上
+//	OpEndTry
+//	OpJump end
+//	catch:         栈顶是异常值
+//	[OpTry rethrow] 有finally时,catch块中的异常也要先执行finally
+//	<绑定或丢弃异常值>
+//	<catch块>
+//	[OpEndTry]
+//	OpJump end
+//	rethrow:       有finally时:执行finally后重新抛出栈顶的异常
+//	<finally>
+//	OpThrow
+//	end:
+//	<finally>      正常结束时执行
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	loopDepth := len(c.scopes[c.scopeIndex].loops)
+	// 捕获异常时栈恢复到OpTry时的深度,再压入异常值
+	depth := c.depth()
+
+	tryPos := c.emit(code.OpTry, 9999)
+	c.enterTry(&TryContext{loopDepth: loopDepth, finally: node.Finally})
+	err := c.compileBlockValue(node.Block)
+	if err != nil {
+		return err
+	}
+	c.leaveTry()
+	c.emit(code.OpEndTry)
+
+	var jumps []int
+	jumps = append(jumps, c.emit(code.OpJump, 9999))
+
+	c.changeOperand(tryPos, len(c.currentInstructions()))
+	c.setDepth(depth + 1)
+	if node.Catch != nil {
+		rethrowPos := -1
+		if node.Finally != nil {
+			rethrowPos = c.emit(code.OpTry, 9999)
+			c.enterTry(&TryContext{loopDepth: loopDepth, finally: node.Finally})
+		}
+
+		if node.Param != nil {
+			symbol := c.symbolTable.Define(node.Param.Value)
+			c.storeSymbol(symbol)
+		} else {
+			c.emit(code.OpPop)
+		}
+
+		err := c.compileBlockValue(node.Catch)
+		if err != nil {
+			return err
+		}
+
+		if node.Finally != nil {
+			c.leaveTry()
+			c.emit(code.OpEndTry)
+			jumps = append(jumps, c.emit(code.OpJump, 9999))
+			c.changeOperand(rethrowPos, len(c.currentInstructions()))
+			c.setDepth(depth + 1)
+		}
+	}
+
+	if node.Finally != nil {
+		// 异常路径:finally中的语句不改变栈,栈顶仍是异常值
+		err := c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+
+	afterPos := len(c.currentInstructions())
+	for _, pos := range jumps {
+		c.changeOperand(pos, afterPos)
+	}
+	c.setDepth(depth + 1)
+
+	if node.Finally != nil {
+		// 正常路径:执行finally,try表达式的值仍在栈上
+		return c.Compile(node.Finally)
+	}
+	return nil
+}
+
+// 编译块并把块的值留在栈上,没有值时压入Null
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	if len(block.Statements) > 0 && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+	return nil
+}
+
+// 进入try
+func (c *Compiler) enterTry(t *TryContext) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.tries = append(scope.tries, t)
+}
+
+// 离开try
+func (c *Compiler) leaveTry() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+}
+
+// 跳出循环层数不少于loopDepth的try:由内向外注销处理器并执行finally
+// finally中的return、break等只会跳出外层的try
+func (c *Compiler) exitTries(loopDepth int) error {
+	tries := c.scopes[c.scopeIndex].tries
+	defer func() { c.scopes[c.scopeIndex].tries = tries }()
+
+	for i := len(tries) - 1; i >= 0 && tries[i].loopDepth >= loopDepth; i-- {
+		t := tries[i]
+		c.scopes[c.scopeIndex].tries = tries[:i]
+
+		c.emit(code.OpEndTry)
+		if t.finally != nil {
+			err := c.Compile(t.finally)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // 最后的指令是否是op
 func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
 	if len(c.currentInstructions()) == 0 {
@@ -467,3 +935,220 @@ func (c *Compiler) loadSymbol(s Symbol) {
 		c.emit(code.OpCurrentClosure)
 	}
 }
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	}
+}
+
+// 创建闭包时捕获自由变量,压栈的是共享的Cell而不是值的副本
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+// 复合赋值运算符对应的指令
+var compoundAssignOps = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+}
+
+// 赋值表达式:修改已声明的变量,表达式的值为赋值后的值
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	if ie, ok := node.Target.(*ast.IndexExpression); ok {
+		return c.compileIndexAssignExpression(node, ie)
+	}
+
+	ident, ok := node.Target.(*ast.Identifier)
+	if !ok {
+		return newError(node, "invalid assignment target %s", node.Target.String())
+	}
+
+	symbol, ok := c.symbolTable.ResolveAssignable(ident.Value)
+	if !ok {
+		return newError(node, "assignment to undeclared variable: %s", ident.Value)
+	}
+	switch symbol.Scope {
+	case BuiltinScope:
+		return newError(node, "cannot assign to builtin: %s", ident.Value)
+	}
+
+	// 赋值后不再是模块,不做编译期的成员检查
+	c.symbolTable.ForgetModule(ident.Value)
+
+	op, compound := compoundAssignOps[node.Operator]
+	if compound {
+		c.loadSymbol(symbol)
+	}
+
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	if compound {
+		c.emit(op)
+	}
+
+	c.storeSymbol(symbol)
+	c.loadSymbol(symbol)
+	return nil
+}
+
+// 索引赋值:依次压入被索引对象、索引和新值,由OpSetIndex写入并留下新值
+func (c *Compiler) compileIndexAssignExpression(node *ast.AssignExpression, ie *ast.IndexExpression) error {
+	err := c.Compile(ie.Left)
+	if err != nil {
+		return err
+	}
+
+	err = c.Compile(ie.Index)
+	if err != nil {
+		return err
+	}
+
+	op, compound := compoundAssignOps[node.Operator]
+	if compound {
+		// 复用栈上的对象和索引读出旧值,避免重复求值
+		c.emit(code.OpDup2)
+		c.emit(code.OpIndex)
+	}
+
+	err = c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	if compound {
+		c.emit(op)
+	}
+
+	c.emit(code.OpSetIndex)
+	return nil
+}
+
+// use导入:模块只编译一次,编译结果作为常量保存在常量池中,
+// 由OpLoadModule在第一次执行到时运行模块顶层代码并得到模块对象
+func (c *Compiler) compileUseExpression(node *ast.UseExpression) error {
+	path, err := c.modules.Resolve(node.FileName, node.Pos())
+	if err != nil {
+		return newError(node, "%s", err)
+	}
+
+	index, ok := c.symbolTable.compiledModules[path]
+	if !ok {
+		index, err = c.compileModule(node, path)
+		if err != nil {
+			return err
+		}
+		c.symbolTable.compiledModules[path] = index
+	}
+
+	c.emit(code.OpLoadModule, index)
+
+	if node.Name != "" {
+		symbol := c.symbolTable.DefineModule(node.Name, c.constants[index].(*object.CompiledModule))
+		c.storeSymbol(symbol)
+		c.loadSymbol(symbol)
+	}
+	return nil
+}
+
+// 编译模块。模块有独立的顶层符号表,绑定存放在共享的全局槽位中。
+// 模块内部的编译错误已带有模块文件的位置,直接返回
+func (c *Compiler) compileModule(node *ast.UseExpression, path string) (int, error) {
+	err := c.modules.Enter(path)
+	if err != nil {
+		return 0, newError(node, "%s", err)
+	}
+	defer c.modules.Leave()
+
+	program, err := c.modules.Parse(path)
+	if err != nil {
+		return 0, newError(node, "%s", err)
+	}
+
+	mod := &object.CompiledModule{
+		Name:    module.Name(path),
+		Exports: make(map[string]int),
+		Global:  c.symbolTable.AllocateGlobal(),
+	}
+
+	symbolTable := c.symbolTable
+	c.symbolTable = NewModuleSymbolTable(symbolTable)
+	c.scopes = append(c.scopes, CompilationScope{})
+	c.scopeIndex++
+
+	err = c.Compile(program)
+	if err == nil {
+		// 模块顶层代码的返回值是模块对象
+		c.emit(code.OpGetGlobal, mod.Global)
+		c.emit(code.OpReturnValue)
+
+		for _, name := range module.Exports(program) {
+			symbol, _ := c.symbolTable.Resolve(name)
+			mod.Exports[name] = symbol.Index
+		}
+	}
+
+	scope := c.scopes[c.scopeIndex]
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+	c.symbolTable = symbolTable
+
+	if err != nil {
+		return 0, err
+	}
+
+	instructions, sourceMap := c.optimizeScope(scope)
+	mod.Init = &object.CompiledFunction{
+		Instructions: instructions,
+		Name:         "<module " + filepath.Base(path) + ">",
+		SourceMap:    sourceMap,
+	}
+	return c.addConstant(mod), nil
+}
+
+// 编译期检查模块成员访问 f.name / f["name"]
+func (c *Compiler) checkModuleMember(node *ast.IndexExpression) error {
+	ident, ok := node.Left.(*ast.Identifier)
+	if !ok {
+		return nil
+	}
+	member, ok := node.Index.(*ast.StringLiteral)
+	if !ok {
+		return nil
+	}
+
+	mod, ok := c.symbolTable.ResolveModule(ident.Value)
+	if !ok {
+		return nil
+	}
+	if _, ok := mod.Exports[member.Value]; !ok {
+		return newError(node.Index, "module %s has no exported member %s", mod.Name, member.Value)
+	}
+	return nil
+}
+
+// 生成带源码位置的编译错误
+func newError(node ast.Node, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if pos := node.Pos(); pos.IsValid() {
+		return fmt.Errorf("%s: %s", pos, msg)
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -1,12 +1,14 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
 	"malang/ast"
 	"malang/code"
 	"malang/lexer"
 	"malang/object"
 	"malang/parser"
+	"reflect"
 	"testing"
 )
 
@@ -46,6 +48,19 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	res, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if res.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", res.Value, expected)
+	}
+
+	return nil
+}
+
 func testStringObject(expected string, actual object.Object) error {
 	res, ok := actual.(*object.String)
 	if !ok {
@@ -76,6 +91,11 @@ func testConstants(
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			err := testFloatObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s", i, err)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 			if err != nil {
@@ -189,7 +209,9 @@ func runCompilerTests(t *testing.T, ts []compilerTestCase) {
 	for _, tt := range ts {
 		program := parse(tt.input)
 
+		// 这些用例检查的是未优化的指令,优化的结果见TestOptimizer
 		compiler := New()
+		compiler.SetOptimize(false)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -242,11 +264,11 @@ func TestBooleanExpression(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
 				code.Make(code.OpPop),
 			},
 		},
@@ -354,6 +376,35 @@ func TestConditional(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			// 以语句结尾或为空的块没有值,补一个Null保持栈平衡
+			input: `
+			if (true) { let a = 1 } else { }; 3333;
+			`,
+			expectedConstants: []interface{}{1, 3333},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpJump, 15),
+				// 0014
+				code.Make(code.OpNull),
+				// 0015
+				code.Make(code.OpPop),
+				// 0016
+				code.Make(code.OpConstant, 1),
+				// 0019
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, ts)
@@ -926,7 +977,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -958,7 +1009,7 @@ func TestClosure(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -988,13 +1039,13 @@ func TestClosure(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -1039,15 +1090,15 @@ func TestClosure(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -1078,7 +1129,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -1107,7 +1158,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -1116,7 +1167,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 2),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -1132,3 +1183,1249 @@ func TestRecursiveFunctions(t *testing.T) {
 
 	runCompilerTests(t, ts)
 }
+
+func TestForLoops(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input:             `for (true) { 1; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpNull),
+				// 0012
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `for (true) { break; continue; }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 15),
+				// 0004
+				code.Make(code.OpJump, 15),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpJump, 0),
+				// 0015
+				code.Make(code.OpNull),
+				// 0016
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 表达式中间的break先弹出循环开始后压入的操作数
+			input:             `for (true) { 1 + if (true) { break } else { 2 } }`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 26),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpTrue),
+				// 0008
+				code.Make(code.OpJumpNotTruthy, 18),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpJump, 26),
+				// 0015
+				code.Make(code.OpJump, 21),
+				// 0018
+				code.Make(code.OpConstant, 1),
+				// 0021
+				code.Make(code.OpAdd),
+				// 0022
+				code.Make(code.OpPop),
+				// 0023
+				code.Make(code.OpJump, 0),
+				// 0026
+				code.Make(code.OpNull),
+				// 0027
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// let重复定义同名全局变量时复用同一个槽位
+			input: `
+			let i = 0;
+			for (i < 2) { let i = i + 1; }
+			`,
+			expectedConstants: []interface{}{0, 2, 1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpLessThan),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 29),
+				// 0016
+				code.Make(code.OpGetGlobal, 0),
+				// 0019
+				code.Make(code.OpConstant, 2),
+				// 0022
+				code.Make(code.OpAdd),
+				// 0023
+				code.Make(code.OpSetGlobal, 0),
+				// 0026
+				code.Make(code.OpJump, 6),
+				// 0029
+				code.Make(code.OpNull),
+				// 0030
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	// 不经过parser检查,直接构造AST
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.ExpressionStatement{Expression: &ast.BreakExpression{}},
+		},
+	}
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	if err.Error() != "break outside of loop" {
+		t.Fatalf("wrong compiler error. got=%q", err)
+	}
+}
+
+func TestLogicalExpressions(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input:             "true && false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0008
+				code.Make(code.OpTrue),
+				// 0009
+				code.Make(code.OpJump, 13),
+				// 0012
+				code.Make(code.OpFalse),
+				// 0013
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "true || false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.Make(code.OpTrue),
+				// 0005
+				code.Make(code.OpJump, 17),
+				// 0008
+				code.Make(code.OpFalse),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 16),
+				// 0012
+				code.Make(code.OpTrue),
+				// 0013
+				code.Make(code.OpJump, 17),
+				// 0016
+				code.Make(code.OpFalse),
+				// 0017
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestCompilerErrorPositions(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 1;\nx + y", "test.mal:2:5: undefined variable y"},
+		{"let f = fn(a) {\n\ta + b\n}", "test.mal:2:6: undefined variable b"},
+	}
+
+	for _, tt := range ts {
+		l := lexer.NewWithFile("test.mal", tt.input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	input := `let x = 1;
+let f = fn() {
+	x + 2
+};
+f();`
+
+	l := lexer.NewWithFile("test.mal", input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// 主程序: 0000 OpConstant, 0003 OpSetGlobal, 0006 OpClosure, 0010 OpSetGlobal,
+	// 0013 OpGetGlobal, 0016 OpCall, 0018 OpPop
+	mainTests := []struct {
+		offset   int
+		expected string
+	}{
+		{0, "test.mal:1:9"},
+		{3, "test.mal:1:1"},
+		{6, "test.mal:2:9"},
+		{10, "test.mal:2:1"},
+		{13, "test.mal:5:1"},
+		{16, "test.mal:5:1"},
+		{18, "test.mal:5:1"},
+	}
+	for _, tt := range mainTests {
+		pos, ok := bytecode.SourceMap.Lookup(tt.offset)
+		if !ok || pos.String() != tt.expected {
+			t.Errorf("wrong position for main offset %d. want=%s, got=%s", tt.offset, tt.expected, pos)
+		}
+	}
+
+	fn, ok := bytecode.Constants[2].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 2 is not CompiledFunction. got=%T", bytecode.Constants[2])
+	}
+	if fn.Name != "f" {
+		t.Errorf("wrong function name. want=%q, got=%q", "f", fn.Name)
+	}
+
+	// 函数体: 0000 OpGetGlobal, 0003 OpConstant, 0006 OpAdd, 0007 OpReturnValue
+	fnTests := []struct {
+		offset   int
+		expected string
+	}{
+		{0, "test.mal:3:2"},
+		{3, "test.mal:3:6"},
+		{6, "test.mal:3:2"},
+		{7, "test.mal:3:2"},
+	}
+	for _, tt := range fnTests {
+		pos, ok := fn.SourceMap.Lookup(tt.offset)
+		if !ok || pos.String() != tt.expected {
+			t.Errorf("wrong position for function offset %d. want=%s, got=%s", tt.offset, tt.expected, pos)
+		}
+	}
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input:             "1.5 + 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-1e-9",
+			expectedConstants: []interface{}{1e-9},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestOperatorSuite(t *testing.T) {
+	ts := []compilerTestCase{}
+
+	binaryOps := []struct {
+		operator string
+		opcode   code.Opcode
+	}{
+		{"%", code.OpMod},
+		{"&", code.OpBitAnd},
+		{"|", code.OpBitOr},
+		{"^", code.OpBitXor},
+		{"<<", code.OpShiftLeft},
+		{">>", code.OpShiftRight},
+		{"<=", code.OpLessThanOrEqual},
+		{">=", code.OpGreaterThanOrEqual},
+	}
+	for _, op := range binaryOps {
+		ts = append(ts, compilerTestCase{
+			input:             fmt.Sprintf("1 %s 2", op.operator),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(op.opcode),
+				code.Make(code.OpPop),
+			},
+		})
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input:             "let x = 1; x = 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x += 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let a = 1; a *= 3 }",
+			expectedConstants: []interface{}{
+				1,
+				3,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpMul),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let a = 1; fn() { a = 2 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestAssignErrors(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 1", "1:1: assignment to undeclared variable: x"},
+		{"let f = fn() {\n\ty += 1\n}", "2:2: assignment to undeclared variable: y"},
+		{"len = 1", "1:1: cannot assign to builtin: len"},
+	}
+
+	for _, tt := range ts {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestIndexAssignExpressions(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input:             "let a = [1]; a[0] = 2",
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = [1]; a[0] += 2",
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDup2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestMalcRoundTrip(t *testing.T) {
+	program := parser.New(lexer.NewWithFile("main.mal", `
+let add = fn(a, b) { a + b };
+let s = "hello";
+puts(add(1, -2), 2.5, s);
+fn(x) { x / 0 }(1);
+`)).ParseProgram()
+
+	comp := New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+	bytecode.Constants = append(bytecode.Constants, &object.CompiledModule{
+		Name:    "mathx",
+		Global:  3,
+		Init:    &object.CompiledFunction{Instructions: code.Make(code.OpNull), Name: "<mathx>"},
+		Exports: map[string]int{"double": 4, "two": 5},
+	})
+
+	ts := []struct {
+		debug bool
+	}{
+		{true},
+		{false},
+	}
+
+	for _, tt := range ts {
+		var buf bytes.Buffer
+		if err := Encode(&buf, bytecode, tt.debug); err != nil {
+			t.Fatalf("encode error: %s", err)
+		}
+		decoded, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("decode error: %s", err)
+		}
+
+		expected := bytecode
+		if !tt.debug {
+			expected = stripDebugInfo(bytecode)
+		}
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("debug=%t: round trip mismatch.\nwant=%#v\ngot=%#v", tt.debug, expected, decoded)
+		}
+	}
+}
+
+// 去掉函数名和源码映射后的字节码副本
+func stripDebugInfo(bytecode *Bytecode) *Bytecode {
+	strip := func(fn *object.CompiledFunction) *object.CompiledFunction {
+		return &object.CompiledFunction{
+			Instructions:  fn.Instructions,
+			NumLocals:     fn.NumLocals,
+			NumParameters: fn.NumParameters,
+		}
+	}
+
+	stripped := &Bytecode{Instructions: bytecode.Instructions, NumGlobals: bytecode.NumGlobals}
+	for _, c := range bytecode.Constants {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			stripped.Constants = append(stripped.Constants, strip(c))
+		case *object.CompiledModule:
+			mod := *c
+			mod.Init = strip(c.Init)
+			stripped.Constants = append(stripped.Constants, &mod)
+		default:
+			stripped.Constants = append(stripped.Constants, c)
+		}
+	}
+	return stripped
+}
+
+func TestMalcDecodeErrors(t *testing.T) {
+	var valid bytes.Buffer
+	comp := New()
+	if err := comp.Compile(parse(`let f = fn() { "x" }; f()`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if err := Encode(&valid, comp.Bytecode(), true); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	ts := []struct {
+		input       []byte
+		expectedErr string
+	}{
+		{[]byte(""), ErrNotMalc.Error()},
+		{[]byte("MAL"), ErrNotMalc.Error()},
+		{[]byte("#!/usr/bin/env malang\n"), ErrNotMalc.Error()},
+		{[]byte("MALC\x03\x00\x00"), "unsupported malc version 3 (want 2)"},
+		{[]byte("MALC\x00\x00\x00"), "unsupported malc version 0 (want 2)"},
+		{valid.Bytes()[:valid.Len()-1], "truncated malc file"},
+		{valid.Bytes()[:12], "truncated malc file"},
+		{[]byte("MALC\x01\x00\x00\x01\x09"), "unknown constant tag 9"},
+		{[]byte("MALC\x01\x00\x00\x80\x80\x80\x40"), "malc length out of range: 134217728"},
+		{[]byte("MALC\x01\x00\x01\x00\x00\x00\x01\x00\x00\x01\x01"), "malc file index out of range: 0"},
+	}
+
+	for _, tt := range ts {
+		_, err := Decode(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("expected error for %q", tt.input)
+			continue
+		}
+		if err.Error() != tt.expectedErr {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expectedErr, err)
+		}
+	}
+}
+
+// 版本1的文件没有全局槽位数,按用到的全局槽位计算
+func TestMalcVersion1(t *testing.T) {
+	bytecode, err := Decode(bytes.NewReader([]byte("MALC\x01\x00\x00\x01\x01\x02\x03\x00\x00\x00")))
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+	expected := &Bytecode{
+		Constants:    []object.Object{&object.Integer{Value: 1}},
+		Instructions: code.Make(code.OpConstant, 0),
+	}
+	if !reflect.DeepEqual(bytecode, expected) {
+		t.Errorf("wrong bytecode.\nwant=%#v\ngot=%#v", expected, bytecode)
+	}
+
+	// 主程序: OpConstant 0; OpSetGlobal 4
+	bytecode, err = Decode(bytes.NewReader([]byte("MALC\x01\x00\x00\x01\x01\x02\x06\x00\x00\x00\x19\x00\x04")))
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+	if bytecode.NumGlobals != 5 {
+		t.Errorf("wrong NumGlobals. want=5, got=%d", bytecode.NumGlobals)
+	}
+	if err := Verify(bytecode); err != nil {
+		t.Errorf("verify error: %s", err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`let f = fn(x) { fn() { x } }; if (f(1)) { "yes" } else { 2.5 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `== <main> ==
+0000 OpClosure 1 0           ; fn f
+0004 OpSetGlobal 0
+0007 OpGetGlobal 0
+0010 OpConstant 2            ; 1
+0013 OpCall 1
+0015 OpJumpNotTruthy L0
+0018 OpConstant 3            ; "yes"
+0021 OpJump L1
+L0:
+0024 OpConstant 4            ; 2.5
+L1:
+0027 OpPop
+
+== fn <anonymous> (constant 0) params=0 locals=0 free=1 ==
+0000 OpGetFree 0
+0002 OpReturnValue
+
+== fn f (constant 1) params=1 locals=1 free=0 ==
+0000 OpCaptureLocal 0
+0002 OpClosure 0 1           ; fn <anonymous>
+0006 OpReturnValue
+`
+	got := Disassemble(comp.Bytecode())
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=%s\ngot=%s", expected, got)
+	}
+
+	// 无法识别的指令不会导致死循环
+	got = Disassemble(&Bytecode{Instructions: append(code.Make(code.OpJump, 4), 255)})
+	expected = "== <main> ==\n0000 OpJump L0\n0003 ERROR: opcode 255 undefined\n"
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot=%q", expected, got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	// 编译器生成的字节码总能通过校验
+	inputs := []string{
+		`let add = fn(a, b) { a + b }; add(1, 2)`,
+		`let counter = fn() { let n = 0; fn() { n += 1; n } }; counter()()`,
+		`let i = 0; for (i < 5) { i += 1; if (i == 2) { continue } let a = [1, if (i > 3) { break } else { 2 }]; }`,
+		`let f = fn(x) { return 1; fn() { x } }; f(2)`,
+		`let g = fn() { try { throw 1 } catch (e) { e } finally { 2 } }; try { g() } catch { 3 }`,
+		`let h = {"a": [1, 2][0]}; h["a"] = 3; h["a"] += 1`,
+		`let fact = fn(n, acc) { if (n == 0) { acc } else { fact(n - 1, acc * n) } }; fact(5, 1)`,
+		`puts(1); return 2; puts(3)`,
+		`try { if (true) { return 1 } } finally { 2 }`,
+	}
+	for _, input := range inputs {
+		for _, optimize := range []bool{true, false} {
+			comp := New()
+			comp.SetOptimize(optimize)
+			if err := comp.Compile(parse(input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			if err := Verify(comp.Bytecode()); err != nil {
+				t.Errorf("%s (optimize=%t): unexpected error: %s", input, optimize, err)
+			}
+		}
+	}
+
+	concat := func(ins ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	fn := func(numLocals int, ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concat(ins...), NumLocals: numLocals, Name: "f"}
+	}
+	one := &object.Integer{Value: 1}
+
+	ts := []struct {
+		bytecode    *Bytecode
+		expectedErr string
+	}{
+		{
+			&Bytecode{Instructions: code.Instructions{255}},
+			"invalid bytecode: <main> at 0000: opcode 255 undefined",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpTrue), []byte{byte(code.OpConstant), 0})},
+			"invalid bytecode: <main> at 0001: truncated OpConstant",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpConstant, 1), code.Make(code.OpPop)), Constants: []object.Object{one}},
+			"invalid bytecode: <main> at 0000: OpConstant: constant index 1 out of range",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpJump, 2), code.Make(code.OpNull))},
+			"invalid bytecode: <main> at 0000: OpJump: jump target 2 is not an instruction boundary",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpTrue), code.Make(code.OpAdd))},
+			"invalid bytecode: <main> at 0001: OpAdd: stack underflow (depth 1, pops 2)",
+		},
+		{
+			// 只有一条分支压入了值
+			&Bytecode{Instructions: concat(
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 5),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			)},
+			"invalid bytecode: <main> at 0004: stack depth mismatch at 0005 (0 and 1)",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpReturn)},
+			"invalid bytecode: <main> at 0000: OpReturn: return outside of function",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpEndTry)},
+			"invalid bytecode: <main> at 0000: OpEndTry: no exception handler to remove",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpGetLocal, 0)},
+			"invalid bytecode: <main> at 0000: OpGetLocal: local index 0 out of range (0 locals)",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpGetGlobal, 2), code.Make(code.OpPop)), NumGlobals: 2},
+			"invalid bytecode: <main> at 0000: OpGetGlobal: global index 2 out of range (2 globals)",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpNull), code.Make(code.OpSetGlobal, 0))},
+			"invalid bytecode: <main> at 0001: OpSetGlobal: global index 0 out of range (0 globals)",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)), Constants: []object.Object{one}},
+			"invalid bytecode: <main> at 0000: OpClosure: constant 0 is not a function",
+		},
+		{
+			&Bytecode{
+				Instructions: concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants:    []object.Object{fn(0, code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue))},
+			},
+			"invalid bytecode: fn f (constant 0) at 0000: OpGetFree: free variable index 0 out of range (0 free)",
+		},
+		{
+			&Bytecode{Constants: []object.Object{fn(1, code.Make(code.OpGetLocal, 0), code.Make(code.OpPop))}},
+			"invalid bytecode: fn f (constant 0) at 0003: function ends without return",
+		},
+		{
+			&Bytecode{Constants: []object.Object{&object.CompiledModule{Name: "m", Global: MaxGlobals, Init: fn(0, code.Make(code.OpReturn))}}},
+			"invalid bytecode: module m (constant 0) at 0000: global index 65536 out of range",
+		},
+	}
+
+	for _, tt := range ts {
+		err := Verify(tt.bytecode)
+		if err == nil {
+			t.Errorf("expected error %q", tt.expectedErr)
+			continue
+		}
+		if _, ok := err.(*VerifyError); !ok {
+			t.Errorf("error is not *VerifyError. got=%T", err)
+		}
+		if err.Error() != tt.expectedErr {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedErr, err)
+		}
+	}
+}
+
+func TestVerifierIncremental(t *testing.T) {
+	one := &object.Integer{Value: 1}
+	f := &object.CompiledFunction{
+		Name:         "f",
+		Instructions: append(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)...),
+	}
+
+	vf := NewVerifier()
+	constants := []object.Object{f}
+	if err := vf.Verify(&Bytecode{Constants: constants}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// 已校验的常量不再检查
+	f.NumLocals = -1
+	f.Instructions = code.Make(code.OpGetLocal, 0)
+	constants = append(constants, one)
+	if err := vf.Verify(&Bytecode{Constants: constants}); err != nil {
+		t.Errorf("verified constant checked again: %s", err)
+	}
+	if err := Verify(&Bytecode{Constants: constants}); err == nil {
+		t.Errorf("expected error from a new verifier")
+	}
+	f.NumLocals = 0
+	f.Instructions = append(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)...)
+
+	// 新的OpClosure以更少的自由变量引用已校验的函数时重新校验
+	err := vf.Verify(&Bytecode{
+		Instructions: append(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)...),
+		Constants:    constants,
+	})
+	expected := "invalid bytecode: fn f (constant 0) at 0000: OpGetFree: free variable index 0 out of range (0 free)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+
+	// 常量池不同时重新校验
+	bad := &object.CompiledFunction{Name: "g", Instructions: code.Make(code.OpNull)}
+	err = vf.Verify(&Bytecode{Constants: []object.Object{bad}})
+	expected = "invalid bytecode: fn g (constant 0) at 0001: function ends without return"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
+
+func TestRegistryBuiltins(t *testing.T) {
+	r := object.NewRegistry()
+	r.Register("double", func(args ...object.Object) object.Object { return args[0] })
+	hostIndex := len(object.Builtins)
+
+	comp := New()
+	comp.SetRegistry(r)
+	err := comp.Compile(parse(`double(len([]))`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []code.Instructions{
+		code.Make(code.OpGetBuiltin, hostIndex),
+		code.Make(code.OpGetBuiltin, 0),
+		code.Make(code.OpArray, 0),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	}
+	if err := testInstructions(expected, comp.Bytecode().Instructions); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	// 没有注册的函数仍然是未定义的变量
+	err = New().Compile(parse(`double(1)`))
+	if err == nil || err.Error() != "1:1: undefined variable double" {
+		t.Errorf("expected undefined variable error, got %v", err)
+	}
+}
+
+func TestRestrictedRegistry(t *testing.T) {
+	r := object.NewRegistry().Restrict(object.CapEnv)
+
+	ts := []struct {
+		input       string
+		expectedErr string
+	}{
+		{`len(getenv("HOME"))`, ""},
+		{`puts(1)`, "1:1: undefined variable puts"},
+		{`fn() { read_file("x") }`, "1:8: undefined variable read_file"},
+		// 同名的全局变量不受影响
+		{`let exit = fn() { 0 }; exit()`, ""},
+	}
+
+	for _, tt := range ts {
+		comp := New()
+		comp.SetRegistry(r)
+		err := comp.Compile(parse(tt.input))
+		if tt.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("%s: want error %q, got %v", tt.input, tt.expectedErr, err)
+		}
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input:             "try { 1 } catch (e) { e }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 10),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpEndTry),
+				// 0007
+				code.Make(code.OpJump, 16),
+				// 0010
+				code.Make(code.OpSetGlobal, 0),
+				// 0013
+				code.Make(code.OpGetGlobal, 0),
+				// 0016
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "try { 1 } finally { 2 }",
+			// finally在每条路径上各编译一次
+			expectedConstants: []interface{}{1, 2, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 10),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpEndTry),
+				// 0007
+				code.Make(code.OpJump, 15),
+				// 0010 异常路径
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpThrow),
+				// 0015 正常路径
+				code.Make(code.OpConstant, 2),
+				// 0018
+				code.Make(code.OpPop),
+				// 0019
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { try { return 1 } finally { 2 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				2,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpTry, 17),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpEndTry),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpNull),
+					code.Make(code.OpEndTry),
+					code.Make(code.OpJump, 22),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpPop),
+					code.Make(code.OpThrow),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpPop),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "throw 1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpThrow),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
+
+func TestOptimizer(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			// 常量折叠
+			input:             "1 + 2 * 3; -1 < 2; 1.5 * 2; \"a\" + \"b\"; !true",
+			expectedConstants: []interface{}{7, 3.0, "ab"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 运行时出错或结果依赖溢出策略的表达式不折叠
+			input:             "1 / 0; 9223372036854775807 + 1",
+			expectedConstants: []interface{}{1, 0, 9223372036854775807},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 数字常量去重,字符串不去重
+			input:             "let x = 1; [x, 1, 2, 1]; \"a\" == \"a\"",
+			expectedConstants: []interface{}{1, 2, "a", "a"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 4),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// return之后的死代码
+			input: "fn() { return 1; 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 内层if的OpJump直接跳到外层if的末尾
+			input:             "let a = true; if (a) { if (a) { 1 } else { 2 } } else { 3 }",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpSetGlobal, 0),
+				// 0004
+				code.Make(code.OpGetGlobal, 0),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 28),
+				// 0010
+				code.Make(code.OpGetGlobal, 0),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0016
+				code.Make(code.OpConstant, 0),
+				// 0019
+				code.Make(code.OpJump, 31),
+				// 0022
+				code.Make(code.OpConstant, 1),
+				// 0025
+				code.Make(code.OpJump, 31),
+				// 0028
+				code.Make(code.OpConstant, 2),
+				// 0031
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// break之后的指令执行不到,跳到下一条指令的OpJump也被删掉
+			input:             "for (true) { break; 1 }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 4),
+				// 0004
+				code.Make(code.OpNull),
+				// 0005
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tt := range ts {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+		err = testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.input, err)
+		}
+		err = testConstants(t, tt.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.input, err)
+		}
+	}
+}
+
+func TestOptimizerSourceMap(t *testing.T) {
+	// 删除指令后源码映射仍然指向原来的位置
+	compiler := New()
+	err := compiler.Compile(parse("for (true) { break; 1 };\nlet x = 1;\nx / 0"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	ins := bytecode.Instructions
+	for offset := 0; offset < len(ins); {
+		def, _ := code.Lookup(ins[offset])
+		if code.Opcode(ins[offset]) == code.OpDiv {
+			pos, ok := bytecode.SourceMap.Lookup(offset)
+			if !ok || pos.Line != 3 || pos.Column != 1 {
+				t.Errorf("wrong position for OpDiv. got=%s", pos)
+			}
+			return
+		}
+		_, read := code.ReadOperands(def, ins[offset+1:])
+		offset += 1 + read
+	}
+	t.Fatalf("OpDiv not found")
+}
+
+func TestTailCalls(t *testing.T) {
+	ts := []compilerTestCase{
+		{
+			input: `let f = fn(n) { if (n) { f(n) } else { 1 } }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpJumpNotTruthy, 13),
+					// 0005
+					code.Make(code.OpCurrentClosure),
+					// 0006
+					code.Make(code.OpGetLocal, 0),
+					// 0008 经过OpJump之后直接返回
+					code.Make(code.OpTailCall, 1),
+					// 0010
+					code.Make(code.OpJump, 16),
+					// 0013
+					code.Make(code.OpConstant, 0),
+					// 0016
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			// 调用的结果还要参与运算,不是尾调用
+			input: `fn() { 1 + len([]) }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpArray, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// try块中的return要先注销异常处理器,不是尾调用
+			input: `fn() { try { return len([]) } catch { 0 } }`,
+			expectedConstants: []interface{}{
+				0,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTry, 17),
+					// 0003
+					code.Make(code.OpGetBuiltin, 0),
+					// 0005
+					code.Make(code.OpArray, 0),
+					// 0008
+					code.Make(code.OpCall, 1),
+					// 0010
+					code.Make(code.OpEndTry),
+					// 0011
+					code.Make(code.OpReturnValue),
+					// 0012
+					code.Make(code.OpNull),
+					// 0013
+					code.Make(code.OpEndTry),
+					// 0014
+					code.Make(code.OpJump, 21),
+					// 0017
+					code.Make(code.OpPop),
+					// 0018
+					code.Make(code.OpConstant, 0),
+					// 0021
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, ts)
+}
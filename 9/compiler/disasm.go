@@ -0,0 +1,144 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"malang/code"
+	"malang/object"
+	"sort"
+)
+
+// 反汇编字节码:先输出主程序,再按常量池的顺序输出每个函数和模块的顶层代码
+// OpConstant等引用常量的指令后面注释常量的值,跳转目标用标签表示
+func Disassemble(bytecode *Bytecode) string {
+	d := &disassembler{constants: bytecode.Constants, numFree: make(map[int]int)}
+
+	// 自由变量的个数只记录在OpClosure的操作数中
+	d.countFree(bytecode.Instructions)
+	for _, c := range bytecode.Constants {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			d.countFree(c.Instructions)
+		case *object.CompiledModule:
+			d.countFree(c.Init.Instructions)
+		}
+	}
+
+	fmt.Fprintf(&d.out, "== <main> ==\n")
+	d.instructions(bytecode.Instructions)
+
+	for i, c := range bytecode.Constants {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			fmt.Fprintf(&d.out, "\n== %s (constant %d) params=%d locals=%d free=%d ==\n",
+				functionName(c), i, c.NumParameters, c.NumLocals, d.numFree[i])
+			d.instructions(c.Instructions)
+		case *object.CompiledModule:
+			fmt.Fprintf(&d.out, "\n== module %s (constant %d) global=%d locals=%d ==\n",
+				c.Name, i, c.Global, c.Init.NumLocals)
+			d.instructions(c.Init.Instructions)
+		}
+	}
+
+	return d.out.String()
+}
+
+type disassembler struct {
+	out       bytes.Buffer
+	constants []object.Object
+	numFree   map[int]int // 函数常量下标 -> 自由变量个数
+}
+
+func functionName(fn *object.CompiledFunction) string {
+	if fn.Name == "" {
+		return "fn <anonymous>"
+	}
+	return "fn " + fn.Name
+}
+
+func (d *disassembler) countFree(ins code.Instructions) {
+	list, _ := decode(ins)
+	for _, inst := range list {
+		if inst.op == code.OpClosure {
+			d.numFree[inst.operands[0]] = inst.operands[1]
+		}
+	}
+}
+
+func (d *disassembler) instructions(ins code.Instructions) {
+	list, err := decode(ins)
+
+	// 按偏移量顺序给跳转目标编号
+	var targets []int
+	labels := make(map[int]string)
+	for _, inst := range list {
+		if isJump(inst.op) {
+			if _, ok := labels[inst.operands[0]]; !ok {
+				labels[inst.operands[0]] = ""
+				targets = append(targets, inst.operands[0])
+			}
+		}
+	}
+	sort.Ints(targets)
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i)
+	}
+
+	for _, inst := range list {
+		if label, ok := labels[inst.offset]; ok {
+			fmt.Fprintf(&d.out, "%s:\n", label)
+		}
+		def, _ := code.Lookup(byte(inst.op))
+		line := fmt.Sprintf("%04d %s", inst.offset, def.Name)
+		for i, operand := range inst.operands {
+			if i == 0 && isJump(inst.op) {
+				line += " " + labels[operand]
+			} else {
+				line += fmt.Sprintf(" %d", operand)
+			}
+		}
+		if comment := d.comment(inst); comment != "" {
+			line = fmt.Sprintf("%-28s ; %s", line, comment)
+		}
+		fmt.Fprintln(&d.out, line)
+	}
+
+	if err != nil {
+		offset := 0
+		if len(list) > 0 {
+			last := list[len(list)-1]
+			offset = last.offset + len(code.Make(last.op, last.operands...))
+		}
+		fmt.Fprintf(&d.out, "%04d ERROR: %s\n", offset, err)
+		return
+	}
+
+	// 跳到末尾的标签
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(&d.out, "%s:\n", label)
+	}
+}
+
+// 引用常量的指令的注释
+func (d *disassembler) comment(inst instruction) string {
+	switch inst.op {
+	case code.OpConstant, code.OpClosure, code.OpLoadModule:
+	default:
+		return ""
+	}
+
+	index := inst.operands[0]
+	if index < 0 || index >= len(d.constants) {
+		return fmt.Sprintf("constant %d out of range", index)
+	}
+	switch c := d.constants[index].(type) {
+	case *object.String:
+		return fmt.Sprintf("%q", c.Value)
+	case *object.CompiledFunction:
+		return functionName(c)
+	case *object.CompiledModule:
+		return "module " + c.Name
+	default:
+		return c.Inspect()
+	}
+}
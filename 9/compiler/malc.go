@@ -0,0 +1,469 @@
+package compiler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"malang/code"
+	"malang/object"
+	"malang/token"
+	"math"
+	"sort"
+)
+
+// .malc 字节码文件格式(多字节整数均为小端或varint):
+//
+//	magic    "MALC"
+//	version  uint16
+//	flags    uint8,FlagDebug表示带有调试信息
+//	globals  uvarint,全局槽位数(版本2起)
+//	[debug]  文件名表: uvarint数量 + 字符串
+//	常量池   uvarint数量 + 每个常量(类型标记 + 内容)
+//	指令     uvarint长度 + 字节
+//	[debug]  主程序的源码映射
+//
+// 调试信息包括函数名和源码映射,用于运行时错误的位置和调用栈
+const (
+	MalcMagic   = "MALC"
+	MalcVersion = 2
+
+	FlagDebug = 1 << 0
+
+	// 单个长度字段的上限
+	maxMalcLength = 1 << 26
+)
+
+// 常量类型标记
+const (
+	tagInteger byte = iota + 1
+	tagFloat
+	tagString
+	tagFunction
+	tagModule
+)
+
+var ErrNotMalc = errors.New("not a malc file")
+
+// 把字节码编码为.malc格式,debug为false时不写入调试信息
+func Encode(w io.Writer, bytecode *Bytecode, debug bool) error {
+	e := &encoder{w: bufio.NewWriter(w), debug: debug, fileIndex: map[string]int{}}
+
+	var flags byte
+	if debug {
+		flags |= FlagDebug
+	}
+	e.bytes([]byte(MalcMagic))
+	e.uint16(MalcVersion)
+	e.bytes([]byte{flags})
+	e.uvarint(bytecode.NumGlobals)
+
+	if debug {
+		e.collectFiles(bytecode)
+		e.uvarint(len(e.files))
+		for _, f := range e.files {
+			e.string(f)
+		}
+	}
+
+	e.uvarint(len(bytecode.Constants))
+	for _, c := range bytecode.Constants {
+		e.constant(c)
+	}
+
+	e.instructions(bytecode.Instructions)
+	if debug {
+		e.sourceMap(bytecode.SourceMap)
+	}
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// 从.malc格式解码字节码
+func Decode(r io.Reader) (*Bytecode, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+
+	magic := d.bytes(len(MalcMagic))
+	if d.err != nil || string(magic) != MalcMagic {
+		return nil, ErrNotMalc
+	}
+
+	version := d.uint16()
+	// 版本1没有记录全局槽位数,读完后按指令计算
+	if d.err == nil && (version < 1 || version > MalcVersion) {
+		return nil, fmt.Errorf("unsupported malc version %d (want %d)", version, MalcVersion)
+	}
+	flags := d.bytes(1)
+	if d.err == nil {
+		d.debug = flags[0]&FlagDebug != 0
+	}
+	bytecode := &Bytecode{}
+	if version >= 2 {
+		bytecode.NumGlobals = d.uvarint()
+	}
+
+	if d.debug {
+		n := d.count()
+		for i := 0; i < n && d.err == nil; i++ {
+			d.files = append(d.files, d.string())
+		}
+	}
+
+	n := d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		bytecode.Constants = append(bytecode.Constants, d.constant())
+	}
+
+	bytecode.Instructions = d.instructions()
+	if d.debug {
+		bytecode.SourceMap = d.sourceMap()
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if version < 2 {
+		bytecode.NumGlobals = usedGlobals(bytecode)
+	}
+	return bytecode, nil
+}
+
+// 版本1的文件没有记录全局槽位数,按用到的最大全局槽位计算
+func usedGlobals(bytecode *Bytecode) int {
+	n := 0
+	use := func(index int) {
+		if index+1 > n {
+			n = index + 1
+		}
+	}
+	scan := func(ins code.Instructions) {
+		list, _ := decode(ins)
+		for _, inst := range list {
+			if inst.op == code.OpGetGlobal || inst.op == code.OpSetGlobal {
+				use(inst.operands[0])
+			}
+		}
+	}
+
+	scan(bytecode.Instructions)
+	for _, c := range bytecode.Constants {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			scan(c.Instructions)
+		case *object.CompiledModule:
+			use(c.Global)
+			for _, global := range c.Exports {
+				use(global)
+			}
+			if c.Init != nil {
+				scan(c.Init.Instructions)
+			}
+		}
+	}
+	return n
+}
+
+type encoder struct {
+	w     *bufio.Writer
+	err   error
+	debug bool
+
+	// 源码映射中的文件名表
+	files     []string
+	fileIndex map[string]int
+}
+
+func (e *encoder) bytes(b []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *encoder) uint16(v uint16) {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	e.bytes(buf[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	e.bytes(buf[:])
+}
+
+func (e *encoder) uvarint(v int) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(v))
+	e.bytes(buf[:n])
+}
+
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	e.bytes(buf[:n])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(len(s))
+	e.bytes([]byte(s))
+}
+
+func (e *encoder) instructions(ins code.Instructions) {
+	e.uvarint(len(ins))
+	e.bytes(ins)
+}
+
+func (e *encoder) constant(obj object.Object) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.bytes([]byte{tagInteger})
+		e.varint(obj.Value)
+	case *object.Float:
+		e.bytes([]byte{tagFloat})
+		e.uint64(math.Float64bits(obj.Value))
+	case *object.String:
+		e.bytes([]byte{tagString})
+		e.string(obj.Value)
+	case *object.CompiledFunction:
+		e.bytes([]byte{tagFunction})
+		e.function(obj)
+	case *object.CompiledModule:
+		e.bytes([]byte{tagModule})
+		e.module(obj)
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("cannot encode constant of type %s", obj.Type())
+		}
+	}
+}
+
+func (e *encoder) function(fn *object.CompiledFunction) {
+	e.uvarint(fn.NumLocals)
+	e.uvarint(fn.NumParameters)
+	e.instructions(fn.Instructions)
+	if e.debug {
+		e.string(fn.Name)
+		e.sourceMap(fn.SourceMap)
+	}
+}
+
+func (e *encoder) module(mod *object.CompiledModule) {
+	e.string(mod.Name)
+	e.uvarint(mod.Global)
+	e.function(mod.Init)
+
+	// 按名字排序,保证相同的输入编码结果相同
+	names := make([]string, 0, len(mod.Exports))
+	for name := range mod.Exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e.uvarint(len(names))
+	for _, name := range names {
+		e.string(name)
+		e.uvarint(mod.Exports[name])
+	}
+}
+
+func (e *encoder) sourceMap(sm code.SourceMap) {
+	e.uvarint(len(sm))
+	for _, m := range sm {
+		e.uvarint(m.Offset)
+		e.uvarint(e.fileIndex[m.Pos.File])
+		e.uvarint(m.Pos.Line)
+		e.uvarint(m.Pos.Column)
+	}
+}
+
+// 收集所有源码映射中出现的文件名
+func (e *encoder) collectFiles(bytecode *Bytecode) {
+	add := func(sm code.SourceMap) {
+		for _, m := range sm {
+			if _, ok := e.fileIndex[m.Pos.File]; !ok {
+				e.fileIndex[m.Pos.File] = len(e.files)
+				e.files = append(e.files, m.Pos.File)
+			}
+		}
+	}
+
+	for _, c := range bytecode.Constants {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			add(c.SourceMap)
+		case *object.CompiledModule:
+			add(c.Init.SourceMap)
+		}
+	}
+	add(bytecode.SourceMap)
+}
+
+type decoder struct {
+	r     *bufio.Reader
+	err   error
+	debug bool
+
+	files []string
+}
+
+func (d *decoder) fail(err error) {
+	if d.err != nil {
+		return
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("truncated malc file")
+	}
+	d.err = err
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.r, buf)
+	if err != nil {
+		d.fail(err)
+		return nil
+	}
+	return buf
+}
+
+func (d *decoder) uint16() uint16 {
+	buf := d.bytes(2)
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(buf)
+}
+
+func (d *decoder) uint64() uint64 {
+	buf := d.bytes(8)
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(buf)
+}
+
+func (d *decoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+		return 0
+	}
+	if v > math.MaxInt32 {
+		d.fail(fmt.Errorf("malc value out of range: %d", v))
+		return 0
+	}
+	return int(v)
+}
+
+// 读取数量或长度,限制大小避免损坏的文件导致分配过多内存
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > maxMalcLength {
+		d.fail(fmt.Errorf("malc length out of range: %d", n))
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail(err)
+		return 0
+	}
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.count()))
+}
+
+func (d *decoder) instructions() code.Instructions {
+	return code.Instructions(d.bytes(d.count()))
+}
+
+func (d *decoder) constant() object.Object {
+	tag := d.bytes(1)
+	if d.err != nil {
+		return nil
+	}
+
+	switch tag[0] {
+	case tagInteger:
+		return &object.Integer{Value: d.varint()}
+	case tagFloat:
+		return &object.Float{Value: math.Float64frombits(d.uint64())}
+	case tagString:
+		return &object.String{Value: d.string()}
+	case tagFunction:
+		return d.function()
+	case tagModule:
+		return d.module()
+	default:
+		d.fail(fmt.Errorf("unknown constant tag %d", tag[0]))
+		return nil
+	}
+}
+
+func (d *decoder) function() *object.CompiledFunction {
+	fn := &object.CompiledFunction{
+		NumLocals:     d.uvarint(),
+		NumParameters: d.uvarint(),
+		Instructions:  d.instructions(),
+	}
+	if d.debug {
+		fn.Name = d.string()
+		fn.SourceMap = d.sourceMap()
+	}
+	return fn
+}
+
+func (d *decoder) module() *object.CompiledModule {
+	mod := &object.CompiledModule{
+		Name:    d.string(),
+		Global:  d.uvarint(),
+		Init:    d.function(),
+		Exports: make(map[string]int),
+	}
+
+	n := d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		name := d.string()
+		mod.Exports[name] = d.uvarint()
+	}
+	return mod
+}
+
+func (d *decoder) sourceMap() code.SourceMap {
+	n := d.count()
+	var sm code.SourceMap
+	for i := 0; i < n && d.err == nil; i++ {
+		offset := d.uvarint()
+		file := d.uvarint()
+		if d.err == nil && file >= len(d.files) {
+			d.fail(fmt.Errorf("malc file index out of range: %d", file))
+			return nil
+		}
+
+		pos := token.Position{Line: d.uvarint(), Column: d.uvarint()}
+		if d.err == nil {
+			pos.File = d.files[file]
+		}
+		sm = append(sm, code.SourceMapping{Offset: offset, Pos: pos})
+	}
+	return sm
+}
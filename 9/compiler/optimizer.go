@@ -0,0 +1,365 @@
+package compiler
+
+import (
+	"fmt"
+	"malang/ast"
+	"malang/code"
+	"malang/object"
+	"math"
+)
+
+// 编译器的优化:
+//   - 常量折叠: 操作数都是字面量的表达式在编译时求值(constantValue)
+//   - 常量池去重: 相同的整数和浮点数常量只保存一份(addConstant)
+//   - 跳转串联: 跳转到OpJump的跳转直接跳到最终目标
+//   - 删除死代码: OpReturnValue、OpJump等之后执行不到的指令,以及跳到下一条指令的OpJump
+//
+// 后两项在函数、模块和主程序编译完成后进行(optimizeInstructions)
+
+// 常量池去重的键
+type constantKey struct {
+	Type  object.ObjectType
+	Value uint64
+}
+
+// 只有整数和浮点数去重
+// 字符串的==比较的是对象本身,共用常量会改变比较结果
+func keyOf(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{Type: obj.Type(), Value: uint64(obj.Value)}, true
+	case *object.Float:
+		return constantKey{Type: obj.Type(), Value: math.Float64bits(obj.Value)}, true
+	default:
+		return constantKey{}, false
+	}
+}
+
+// 求字面量组成的表达式的值,不能在编译时求值时返回false
+// 结果必须与虚拟机执行的结果相同,会产生运行时错误或依赖溢出策略的表达式不折叠
+func constantValue(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}, true
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+	case *ast.Boolean:
+		return nativeBoolean(node.Value), true
+	case *ast.PrefixExpression:
+		right, ok := constantValue(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return nil, false
+		}
+		left, ok := constantValue(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := constantValue(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+	default:
+		return nil, false
+	}
+}
+
+func nativeBoolean(b bool) *object.Boolean {
+	if b {
+		return object.TRUE
+	}
+	return object.FALSE
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch right := right.(type) {
+	case *object.Integer:
+		if operator == "-" && right.Value != math.MinInt64 {
+			return &object.Integer{Value: -right.Value}, true
+		}
+	case *object.Float:
+		if operator == "-" {
+			return &object.Float{Value: -right.Value}, true
+		}
+	case *object.Boolean:
+		if operator == "!" {
+			return nativeBoolean(!right.Value), true
+		}
+	}
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch {
+	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
+		return foldInteger(operator, left.(*object.Integer).Value, right.(*object.Integer).Value)
+	case isNumber(left) && isNumber(right):
+		return foldFloat(operator, toFloat(left), toFloat(right))
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ && operator == "+":
+		return &object.String{Value: left.(*object.String).Value + right.(*object.String).Value}, true
+	case left.Type() == object.BOOLEAN_OBJ && right.Type() == object.BOOLEAN_OBJ:
+		switch operator {
+		case "==":
+			return nativeBoolean(left == right), true
+		case "!=":
+			return nativeBoolean(left != right), true
+		}
+	}
+	return nil, false
+}
+
+func foldInteger(operator string, l, r int64) (object.Object, bool) {
+	var res int64
+
+	switch operator {
+	case "+":
+		res = l + r
+		if (l > 0 && r > 0 && res < 0) || (l < 0 && r < 0 && res >= 0) {
+			return nil, false
+		}
+	case "-":
+		res = l - r
+		if (l >= 0 && r < 0 && res < 0) || (l < 0 && r > 0 && res >= 0) {
+			return nil, false
+		}
+	case "*":
+		res = l * r
+		if l != 0 && (res/l != r || (l == -1 && r == math.MinInt64)) {
+			return nil, false
+		}
+	case "/":
+		if r == 0 || (l == math.MinInt64 && r == -1) {
+			return nil, false
+		}
+		res = l / r
+	case "%":
+		if r == 0 {
+			return nil, false
+		}
+		res = l % r
+	case "&":
+		res = l & r
+	case "|":
+		res = l | r
+	case "^":
+		res = l ^ r
+	case "<<", ">>":
+		if r < 0 {
+			return nil, false
+		}
+		if operator == "<<" {
+			res = l << uint64(r)
+		} else {
+			res = l >> uint64(r)
+		}
+	case "<":
+		return nativeBoolean(l < r), true
+	case ">":
+		return nativeBoolean(l > r), true
+	case "<=":
+		return nativeBoolean(l <= r), true
+	case ">=":
+		return nativeBoolean(l >= r), true
+	case "==":
+		return nativeBoolean(l == r), true
+	case "!=":
+		return nativeBoolean(l != r), true
+	default:
+		return nil, false
+	}
+
+	return &object.Integer{Value: res}, true
+}
+
+func foldFloat(operator string, l, r float64) (object.Object, bool) {
+	switch operator {
+	case "+":
+		return &object.Float{Value: l + r}, true
+	case "-":
+		return &object.Float{Value: l - r}, true
+	case "*":
+		return &object.Float{Value: l * r}, true
+	case "/":
+		return &object.Float{Value: l / r}, true
+	case "%":
+		return &object.Float{Value: math.Mod(l, r)}, true
+	case "<":
+		return nativeBoolean(l < r), true
+	case ">":
+		return nativeBoolean(l > r), true
+	case "<=":
+		return nativeBoolean(l <= r), true
+	case ">=":
+		return nativeBoolean(l >= r), true
+	case "==":
+		return nativeBoolean(l == r), true
+	case "!=":
+		return nativeBoolean(l != r), true
+	default:
+		return nil, false
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
+// 发出压入常量值的指令
+func (c *Compiler) emitConstant(obj object.Object) {
+	switch obj {
+	case object.TRUE:
+		c.emit(code.OpTrue)
+	case object.FALSE:
+		c.emit(code.OpFalse)
+	default:
+		c.emit(code.OpConstant, c.addConstant(obj))
+	}
+}
+
+// 操作数是跳转目标的指令
+func isJump(op code.Opcode) bool {
+	return op == code.OpJump || op == code.OpJumpNotTruthy || op == code.OpTry
+}
+
+// 执行后不会继续执行下一条指令
+func isTerminal(op code.Opcode) bool {
+	return op == code.OpJump || op == code.OpReturnValue || op == code.OpReturn || op == code.OpThrow
+}
+
+// 解码后的一条指令
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	operands []int
+}
+
+// 解码一段指令,遇到无法识别或不完整的指令时停止
+func decode(ins code.Instructions) ([]instruction, error) {
+	var list []instruction
+	for offset := 0; offset < len(ins); {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return list, err
+		}
+		if !def.Fits(ins[offset+1:]) {
+			return list, fmt.Errorf("truncated %s", def.Name)
+		}
+		operands, read := code.ReadOperands(def, ins[offset+1:])
+		list = append(list, instruction{offset: offset, op: code.Opcode(ins[offset]), operands: operands})
+		offset += 1 + read
+	}
+	return list, nil
+}
+
+// 串联跳转并删除死代码,重新计算跳转目标和源码映射
+func optimizeInstructions(ins code.Instructions, sm code.SourceMap) (code.Instructions, code.SourceMap) {
+	list, err := decode(ins)
+	if err != nil {
+		// 无法识别的指令,保持原样
+		return ins, sm
+	}
+	index := make(map[int]int, len(list)) // 偏移量 -> list中的下标
+	for i, inst := range list {
+		index[inst.offset] = i
+	}
+
+	// 跳转串联
+	for i := range list {
+		if !isJump(list[i].op) {
+			continue
+		}
+		target := list[i].operands[0]
+		// 最多串联len(list)次,避免死循环的跳转环
+		for n := 0; n < len(list); n++ {
+			j, ok := index[target]
+			if !ok || list[j].op != code.OpJump || list[j].operands[0] == target {
+				break
+			}
+			target = list[j].operands[0]
+		}
+		list[i].operands[0] = target
+	}
+
+	// 从第一条指令开始标记可以执行到的指令
+	live := make([]bool, len(list))
+	work := []int{0}
+	for len(work) > 0 && len(list) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(list) || live[i] {
+			continue
+		}
+		live[i] = true
+
+		if isJump(list[i].op) {
+			if j, ok := index[list[i].operands[0]]; ok {
+				work = append(work, j)
+			}
+		}
+		if !isTerminal(list[i].op) {
+			work = append(work, i+1)
+		}
+	}
+
+	// 跳到下一条执行得到的指令的OpJump可以删掉
+	for i := range list {
+		if !live[i] || list[i].op != code.OpJump {
+			continue
+		}
+		next := len(ins)
+		for j := i + 1; j < len(list); j++ {
+			if live[j] {
+				next = list[j].offset
+				break
+			}
+		}
+		if list[i].operands[0] == next {
+			live[i] = false
+		}
+	}
+
+	// 旧偏移量 -> 新偏移量,被删除的指令对应到它之后的第一条保留的指令
+	newOffsets := make(map[int]int, len(list)+1)
+	offset := 0
+	for i, inst := range list {
+		newOffsets[inst.offset] = offset
+		if live[i] {
+			offset += len(code.Make(inst.op, inst.operands...))
+		}
+	}
+	newOffsets[len(ins)] = offset
+
+	out := make(code.Instructions, 0, offset)
+	var outMap code.SourceMap
+	for i, inst := range list {
+		if !live[i] {
+			continue
+		}
+		if isJump(inst.op) {
+			inst.operands[0] = newOffsets[inst.operands[0]]
+		}
+		if pos, ok := sm.Lookup(inst.offset); ok {
+			outMap = outMap.Add(len(out), pos)
+		}
+		out = append(out, code.Make(inst.op, inst.operands...)...)
+	}
+
+	return out, outMap
+}
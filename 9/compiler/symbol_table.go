@@ -1,5 +1,7 @@
 package compiler
 
+import "malang/object"
+
 type SymbolScope string
 
 const (
@@ -23,18 +25,109 @@ type SymbolTable struct {
 	numDefinitions int
 
 	FreeSymbols []Symbol
+
+	// 全局槽位计数,主程序和各模块的顶层符号表共享,保证槽位不冲突
+	numGlobals *int
+	// 绑定到模块对象的名字(use foo as f),用于在编译期检查f.name
+	modules map[string]*object.CompiledModule
+	// 已编译的模块在常量池中的下标,与全局槽位一样共享,
+	// repl和Runtime多次编译时每个模块仍然只编译和初始化一次
+	compiledModules map[string]int
+
+	// 定义内置函数所用的注册表,模块的符号表沿用同一个
+	registry *object.Registry
 }
 
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	s := NewSymbolTable()
 	s.Outer = outer
+	s.compiledModules = outer.compiledModules
 	return s
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
 	free := []Symbol{}
-	return &SymbolTable{store: s, FreeSymbols: free}
+	return &SymbolTable{
+		store:       s,
+		FreeSymbols: free,
+		numGlobals:  new(int),
+		modules:     make(map[string]*object.CompiledModule),
+
+		compiledModules: make(map[string]int),
+	}
+}
+
+// 创建模块的顶层符号表:模块有独立的命名空间,但与outer共享全局槽位
+func NewModuleSymbolTable(outer *SymbolTable) *SymbolTable {
+	for outer.Outer != nil {
+		outer = outer.Outer
+	}
+
+	s := NewSymbolTable()
+	s.numGlobals = outer.numGlobals
+	s.compiledModules = outer.compiledModules
+	if outer.registry != nil {
+		s.DefineBuiltins(outer.registry)
+	} else {
+		s.DefineBuiltins(object.NewRegistry())
+	}
+	return s
+}
+
+// 全局符号表的状态,编译失败时恢复,避免留下没有值的全局变量
+type SymbolTableState struct {
+	store           map[string]Symbol
+	modules         map[string]*object.CompiledModule
+	numGlobals      int
+	compiledModules map[string]int
+}
+
+// 保存全局符号表的状态
+func (s *SymbolTable) Save() *SymbolTableState {
+	state := &SymbolTableState{
+		store:      make(map[string]Symbol, len(s.store)),
+		modules:    make(map[string]*object.CompiledModule, len(s.modules)),
+		numGlobals: *s.numGlobals,
+
+		compiledModules: make(map[string]int, len(s.compiledModules)),
+	}
+	for name, symbol := range s.store {
+		state.store[name] = symbol
+	}
+	for name, mod := range s.modules {
+		state.modules[name] = mod
+	}
+	for path, index := range s.compiledModules {
+		state.compiledModules[path] = index
+	}
+	return state
+}
+
+// 恢复到Save时的状态
+func (s *SymbolTable) Restore(state *SymbolTableState) {
+	s.store = state.store
+	s.modules = state.modules
+	*s.numGlobals = state.numGlobals
+	s.compiledModules = state.compiledModules
+}
+
+// 分配一个没有名字的全局槽位
+func (s *SymbolTable) AllocateGlobal() int {
+	for s.Outer != nil {
+		s = s.Outer
+	}
+	index := *s.numGlobals
+	*s.numGlobals++
+	return index
+}
+
+// 已分配的全局槽位数,包括模块的全局变量
+func (s *SymbolTable) NumGlobals() int {
+	for s.Outer != nil {
+		s = s.Outer
+	}
+	return *s.numGlobals
 }
 
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
@@ -48,9 +141,18 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 }
 
 func (s *SymbolTable) Define(name string) Symbol {
+	// 同一作用域内重复定义,复用原来的槽位(与求值器中let覆盖同名绑定的行为一致)
+	delete(s.modules, name)
+	if existing, ok := s.store[name]; ok &&
+		(existing.Scope == GlobalScope || existing.Scope == LocalScope) {
+		return existing
+	}
+
 	symbol := Symbol{Name: name, Index: s.numDefinitions}
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
+		symbol.Index = *s.numGlobals
+		*s.numGlobals++
 	} else {
 		symbol.Scope = LocalScope
 	}
@@ -60,6 +162,36 @@ func (s *SymbolTable) Define(name string) Symbol {
 	return symbol
 }
 
+// 定义绑定到模块对象的名字
+func (s *SymbolTable) DefineModule(name string, mod *object.CompiledModule) Symbol {
+	symbol := s.Define(name)
+	s.modules[name] = mod
+	return symbol
+}
+
+// 查找名字绑定的模块,名字被重新定义或赋值后不再视为模块
+func (s *SymbolTable) ResolveModule(name string) (*object.CompiledModule, bool) {
+	for table := s; table != nil; table = table.Outer {
+		symbol, ok := table.store[name]
+		if ok && symbol.Scope != FreeScope {
+			mod, ok := table.modules[name]
+			return mod, ok
+		}
+	}
+	return nil, false
+}
+
+// 名字被赋值后不再绑定到模块
+func (s *SymbolTable) ForgetModule(name string) {
+	for table := s; table != nil; table = table.Outer {
+		symbol, ok := table.store[name]
+		if ok && symbol.Scope != FreeScope {
+			delete(table.modules, name)
+			return
+		}
+	}
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
@@ -78,12 +210,55 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+// 解析赋值目标。函数名绑定是只读的,赋值时跳过它,
+// 改为解析外层作用域中的同名变量
+func (s *SymbolTable) ResolveAssignable(name string) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if ok && obj.Scope != FunctionScope && obj.Scope != FreeScope {
+		return obj, true
+	}
+	if s.Outer == nil {
+		return obj, ok
+	}
+
+	outer, ok := s.Outer.ResolveAssignable(name)
+	if !ok {
+		return outer, false
+	}
+	if outer.Scope == GlobalScope || outer.Scope == BuiltinScope {
+		return outer, true
+	}
+
+	// 已经捕获过同一个变量,直接复用
+	if obj.Scope == FreeScope && s.FreeSymbols[obj.Index] == outer {
+		return obj, true
+	}
+	return s.defineFree(outer), true
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.store[name] = symbol
 	return symbol
 }
 
+// 定义注册表中所有已授权的内置函数,替换之前定义的内置函数,不覆盖同名的其他绑定
+func (s *SymbolTable) DefineBuiltins(r *object.Registry) {
+	for name, symbol := range s.store {
+		if symbol.Scope == BuiltinScope {
+			delete(s.store, name)
+		}
+	}
+
+	s.registry = r
+	for i, name := range r.Names() {
+		if _, ok := s.store[name]; ok || r.Permitted(i) != nil {
+			continue
+		}
+		s.DefineBuiltin(i, name)
+	}
+}
+
 func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
 	s.store[name] = symbol
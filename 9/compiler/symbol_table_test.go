@@ -1,6 +1,9 @@
 package compiler
 
-import "testing"
+import (
+	"malang/object"
+	"testing"
+)
 
 func TestDefine(t *testing.T) {
 	expected := map[string]Symbol{
@@ -311,8 +314,8 @@ func TestShadowingFunctionName(t *testing.T) {
 	global := NewSymbolTable()
 	global.DefineFunctionName("a")
 	global.Define("a")
-	
-	expected := Symbol{Name: "a", Scope: FunctionScope, Index: 0}
+
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
 
 	res, ok := global.Resolve(expected.Name)
 	if !ok {
@@ -322,4 +325,54 @@ func TestShadowingFunctionName(t *testing.T) {
 	if res != expected {
 		t.Errorf("expected %s to resolve to %+v, got=%+v", expected.Name, expected, res)
 	}
-}
\ No newline at end of file
+}
+func TestModuleSymbolTable(t *testing.T) {
+	global := NewSymbolTable()
+	a := global.Define("a")
+
+	mod := NewModuleSymbolTable(global)
+	b := mod.Define("b")
+	slot := global.AllocateGlobal()
+	c := global.Define("c")
+
+	// 模块与主程序共享全局槽位
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: GlobalScope, Index: 1},
+		{Name: "c", Scope: GlobalScope, Index: 3},
+	}
+	for i, sym := range []Symbol{a, b, c} {
+		if sym != expected[i] {
+			t.Errorf("expected %+v, got=%+v", expected[i], sym)
+		}
+	}
+	if slot != 2 {
+		t.Errorf("expected slot 2, got=%d", slot)
+	}
+
+	// 模块有独立的命名空间,但可以使用内置函数
+	if _, ok := mod.Resolve("a"); ok {
+		t.Errorf("name a should not be resolvable in module")
+	}
+	if sym, ok := mod.Resolve("len"); !ok || sym.Scope != BuiltinScope {
+		t.Errorf("builtin len not resolvable in module. got=%+v", sym)
+	}
+
+	m := &object.CompiledModule{Name: "m"}
+	global.DefineModule("m", m)
+	local := NewEnclosedSymbolTable(global)
+
+	if resolved, ok := local.ResolveModule("m"); !ok || resolved != m {
+		t.Errorf("module m not resolved. got=%v", resolved)
+	}
+
+	local.Define("m")
+	if _, ok := local.ResolveModule("m"); ok {
+		t.Errorf("shadowed name m should not resolve to a module")
+	}
+
+	global.ForgetModule("m")
+	if _, ok := global.ResolveModule("m"); ok {
+		t.Errorf("name m should not resolve to a module after assignment")
+	}
+}
@@ -0,0 +1,354 @@
+package compiler
+
+import (
+	"fmt"
+	"malang/code"
+	"malang/object"
+)
+
+// 字节码校验失败的错误
+type VerifyError struct {
+	Function string // 出错的函数,主程序为<main>
+	Offset   int    // 出错指令的偏移量
+	Message  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("invalid bytecode: %s at %04d: %s", e.Function, e.Offset, e.Message)
+}
+
+// 在执行之前检查字节码,保证虚拟机执行时不会因为格式错误而崩溃:
+//   - 操作码有定义,操作数没有超出指令末尾
+//   - 跳转目标落在指令的起始位置
+//   - 常量、局部变量、自由变量的下标在范围内,全局槽位的下标小于NumGlobals
+//   - 任何路径上都不会弹出比压入更多的值,函数不会执行到末尾而不返回
+//
+// 虚拟机在Run之前会自动校验,手工构造或从文件读取的字节码也可以直接调用
+func Verify(bytecode *Bytecode) error {
+	return NewVerifier().Verify(bytecode)
+}
+
+// 增量校验器,记录已经校验过的常量池,之后只校验新增的常量
+// repl和嵌入的Runtime每次执行都使用在原来基础上追加的常量池,
+// 复用同一个Verifier可以避免每次都重新校验标准库和之前的定义
+type Verifier struct {
+	constants []object.Object // 已校验的常量池
+	numFree   map[int]int     // 函数常量下标 -> 自由变量个数
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{numFree: make(map[int]int)}
+}
+
+// 校验字节码,常量池以已校验的常量池开头时只校验新增的常量
+func (vf *Verifier) Verify(bytecode *Bytecode) error {
+	checked := vf.checkedPrefix(bytecode.Constants)
+
+	v := &verifier{constants: bytecode.Constants, numGlobals: bytecode.NumGlobals, numFree: make(map[int]int)}
+	for index, n := range vf.numFree {
+		if index < checked {
+			v.numFree[index] = n
+		}
+	}
+
+	// 自由变量的个数由创建闭包的OpClosure决定,同一个函数取最小值
+	// 已校验的函数被新的OpClosure以更少的自由变量引用时需要重新校验
+	recheck := v.countFree(bytecode.Instructions, checked)
+	for _, c := range bytecode.Constants[checked:] {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			recheck = append(recheck, v.countFree(c.Instructions, checked)...)
+		case *object.CompiledModule:
+			if c.Init != nil {
+				recheck = append(recheck, v.countFree(c.Init.Instructions, checked)...)
+			}
+		}
+	}
+
+	err := v.verify("<main>", bytecode.Instructions, 0, 0, false)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range recheck {
+		if err := v.verifyConstant(i); err != nil {
+			return err
+		}
+	}
+	for i := checked; i < len(bytecode.Constants); i++ {
+		if err := v.verifyConstant(i); err != nil {
+			return err
+		}
+	}
+
+	vf.constants = bytecode.Constants
+	vf.numFree = v.numFree
+	return nil
+}
+
+// constants开头与已校验的常量池相同的常量个数,这些常量不需要重新校验
+func (vf *Verifier) checkedPrefix(constants []object.Object) int {
+	n := 0
+	for n < len(constants) && n < len(vf.constants) && constants[n] == vf.constants[n] {
+		n++
+	}
+	return n
+}
+
+type verifier struct {
+	constants  []object.Object
+	numGlobals int
+	numFree    map[int]int // 函数常量下标 -> 自由变量个数
+}
+
+func (v *verifier) verifyConstant(i int) error {
+	switch c := v.constants[i].(type) {
+	case *object.CompiledFunction:
+		// 没有被OpClosure引用的函数不会被执行,不检查自由变量
+		numFree, ok := v.numFree[i]
+		if !ok {
+			numFree = -1
+		}
+		name := fmt.Sprintf("%s (constant %d)", functionName(c), i)
+		return v.verify(name, c.Instructions, c.NumLocals, numFree, true)
+	case *object.CompiledModule:
+		return v.verifyModule(c, i)
+	}
+	return nil
+}
+
+// 记录OpClosure引用的函数的自由变量个数,返回需要重新校验的已校验函数
+func (v *verifier) countFree(ins code.Instructions, checked int) []int {
+	var recheck []int
+	list, _ := decode(ins)
+	for _, inst := range list {
+		if inst.op != code.OpClosure {
+			continue
+		}
+		index, numFree := inst.operands[0], inst.operands[1]
+		if n, ok := v.numFree[index]; !ok || numFree < n {
+			v.numFree[index] = numFree
+			if index < checked {
+				recheck = append(recheck, index)
+			}
+		}
+	}
+	return recheck
+}
+
+func (v *verifier) verifyModule(mod *object.CompiledModule, index int) error {
+	name := fmt.Sprintf("module %s (constant %d)", mod.Name, index)
+	if mod.Init == nil {
+		return &VerifyError{Function: name, Message: "module without init function"}
+	}
+	if mod.Global < 0 || mod.Global >= v.numGlobals {
+		return &VerifyError{Function: name, Message: fmt.Sprintf("global index %d out of range", mod.Global)}
+	}
+	for export, global := range mod.Exports {
+		if global < 0 || global >= v.numGlobals {
+			return &VerifyError{Function: name, Message: fmt.Sprintf("export %s: global index %d out of range", export, global)}
+		}
+	}
+	return v.verify(name, mod.Init.Instructions, mod.Init.NumLocals, 0, true)
+}
+
+// 从某条指令开始执行时的状态
+type verifyState struct {
+	depth int // 栈深度,不包括局部变量
+	tries int // 登记的异常处理器个数
+}
+
+// 检查一段指令,numFree为-1表示自由变量个数未知
+// function为false表示主程序:可以执行到末尾结束,OpReturnValue结束执行
+func (v *verifier) verify(name string, ins code.Instructions, numLocals, numFree int, function bool) error {
+	fail := func(offset int, format string, args ...interface{}) error {
+		return &VerifyError{Function: name, Offset: offset, Message: fmt.Sprintf(format, args...)}
+	}
+
+	list, err := decode(ins)
+	if err != nil {
+		offset := 0
+		if len(list) > 0 {
+			last := list[len(list)-1]
+			offset = last.offset + len(code.Make(last.op, last.operands...))
+		}
+		return fail(offset, "%s", err)
+	}
+
+	index := make(map[int]int, len(list)) // 偏移量 -> list中的下标
+	for i, inst := range list {
+		index[inst.offset] = i
+	}
+	index[len(ins)] = len(list)
+
+	// 不依赖执行路径的检查
+	for _, inst := range list {
+		if err := v.checkOperands(inst, index, numLocals, numFree); err != "" {
+			return fail(inst.offset, "%s: %s", opName(inst.op), err)
+		}
+	}
+
+	// 沿所有执行路径计算栈深度,分支汇合处的状态必须相同
+	states := make([]*verifyState, len(list)+1)
+	work := []int{}
+	flow := func(from, i int, s verifyState) error {
+		if old := states[i]; old != nil {
+			if s.depth != old.depth {
+				return fail(from, "stack depth mismatch at %04d (%d and %d)", offsetOf(list, ins, i), old.depth, s.depth)
+			}
+			if s.tries != old.tries {
+				return fail(from, "exception handler mismatch at %04d (%d and %d)", offsetOf(list, ins, i), old.tries, s.tries)
+			}
+			return nil
+		}
+		states[i] = &s
+		work = append(work, i)
+		return nil
+	}
+	flow(0, 0, verifyState{})
+
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		s := *states[i]
+
+		if i == len(list) {
+			if function {
+				return fail(len(ins), "function ends without return")
+			}
+			continue
+		}
+		inst := list[i]
+
+		pop, push := stackEffect(inst)
+		if s.depth < pop {
+			return fail(inst.offset, "%s: stack underflow (depth %d, pops %d)", opName(inst.op), s.depth, pop)
+		}
+		s.depth += push - pop
+
+		var err error
+		switch inst.op {
+		case code.OpReturn:
+			// 主程序中的return只会编译为OpReturnValue
+			if !function {
+				return fail(inst.offset, "%s: return outside of function", opName(inst.op))
+			}
+		case code.OpTry:
+			// 捕获异常时恢复OpTry时的栈深度,再压入异常值
+			err = flow(inst.offset, index[inst.operands[0]], verifyState{depth: s.depth + 1, tries: s.tries})
+			s.tries++
+		case code.OpEndTry:
+			if s.tries == 0 {
+				return fail(inst.offset, "%s: no exception handler to remove", opName(inst.op))
+			}
+			s.tries--
+		case code.OpJump, code.OpJumpNotTruthy:
+			err = flow(inst.offset, index[inst.operands[0]], s)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !isTerminal(inst.op) {
+			if err := flow(inst.offset, i+1, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// list中第i条指令的偏移量,i为len(list)时是指令的末尾
+func offsetOf(list []instruction, ins code.Instructions, i int) int {
+	if i == len(list) {
+		return len(ins)
+	}
+	return list[i].offset
+}
+
+// 检查操作数,返回错误信息,没有错误时返回空字符串
+func (v *verifier) checkOperands(inst instruction, index map[int]int, numLocals, numFree int) string {
+	switch inst.op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpTry:
+		if _, ok := index[inst.operands[0]]; !ok {
+			return fmt.Sprintf("jump target %d is not an instruction boundary", inst.operands[0])
+		}
+	case code.OpConstant:
+		if inst.operands[0] >= len(v.constants) {
+			return fmt.Sprintf("constant index %d out of range", inst.operands[0])
+		}
+	case code.OpClosure:
+		if inst.operands[0] >= len(v.constants) {
+			return fmt.Sprintf("constant index %d out of range", inst.operands[0])
+		}
+		if _, ok := v.constants[inst.operands[0]].(*object.CompiledFunction); !ok {
+			return fmt.Sprintf("constant %d is not a function", inst.operands[0])
+		}
+	case code.OpLoadModule:
+		if inst.operands[0] >= len(v.constants) {
+			return fmt.Sprintf("constant index %d out of range", inst.operands[0])
+		}
+		if _, ok := v.constants[inst.operands[0]].(*object.CompiledModule); !ok {
+			return fmt.Sprintf("constant %d is not a module", inst.operands[0])
+		}
+	case code.OpGetGlobal, code.OpSetGlobal:
+		if inst.operands[0] >= v.numGlobals {
+			return fmt.Sprintf("global index %d out of range (%d globals)", inst.operands[0], v.numGlobals)
+		}
+	case code.OpGetLocal, code.OpSetLocal, code.OpCaptureLocal:
+		if inst.operands[0] >= numLocals {
+			return fmt.Sprintf("local index %d out of range (%d locals)", inst.operands[0], numLocals)
+		}
+	case code.OpGetFree, code.OpSetFree, code.OpCaptureFree:
+		if numFree >= 0 && inst.operands[0] >= numFree {
+			return fmt.Sprintf("free variable index %d out of range (%d free)", inst.operands[0], numFree)
+		}
+	case code.OpHash:
+		if inst.operands[0]%2 != 0 {
+			return fmt.Sprintf("odd number of hash elements %d", inst.operands[0])
+		}
+	}
+	return ""
+}
+
+// 指令弹出和压入的值的个数
+func stackEffect(inst instruction) (pop, push int) {
+	switch inst.op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal,
+		code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree, code.OpCurrentClosure,
+		code.OpCaptureLocal, code.OpCaptureFree, code.OpLoadModule:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan, code.OpGreaterThanOrEqual,
+		code.OpLessThanOrEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang:
+		return 1, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal,
+		code.OpSetFree, code.OpReturnValue, code.OpThrow:
+		return 1, 0
+	case code.OpArray, code.OpHash:
+		return inst.operands[0], 1
+	case code.OpCall, code.OpTailCall:
+		// 被调用的函数和参数替换为返回值
+		return inst.operands[0] + 1, 1
+	case code.OpClosure:
+		return inst.operands[1], 1
+	case code.OpSetIndex:
+		return 3, 1
+	case code.OpDup2:
+		return 2, 4
+	default:
+		// OpJump、OpReturn、OpTry、OpEndTry
+		return 0, 0
+	}
+}
+
+func opName(op code.Opcode) string {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return fmt.Sprintf("opcode %d", op)
+	}
+	return def.Name
+}
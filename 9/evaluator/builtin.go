@@ -19,5 +19,29 @@ var builtins = map[string]*object.Builtin{
 	"rest": object.GetBuiltinByName("rest"),
 	// 向数组末尾添加新元素,返回一个新数组
 	"push": object.GetBuiltinByName("push"),
-	// todo: 文件读写 网络编程 数据库(用原生的"database/sql")
+	// 转换为整数(浮点数向零取整,字符串按字面量解析)
+	"int": object.GetBuiltinByName("int"),
+	// 转换为浮点数
+	"float": object.GetBuiltinByName("float"),
+	// 返回脚本的命令行参数数组
+	"args": object.GetBuiltinByName("args"),
+	// 读取环境变量,未设置时返回null
+	"getenv": object.GetBuiltinByName("getenv"),
+	// 以指定的退出码结束程序
+	"exit": object.GetBuiltinByName("exit"),
+	// 读取整个文件,返回字符串
+	"read_file": object.GetBuiltinByName("read_file"),
+	// 写入文件(覆盖原有内容)
+	"write_file": object.GetBuiltinByName("write_file"),
+	// 追加到文件末尾
+	"append_file": object.GetBuiltinByName("append_file"),
+	// 按行读取文件,返回字符串数组
+	"read_lines": object.GetBuiltinByName("read_lines"),
+	// 文件或目录是否存在
+	"exists": object.GetBuiltinByName("exists"),
+	// 列出目录中的文件名(已排序)
+	"list_dir": object.GetBuiltinByName("list_dir"),
+	// 删除文件或空目录
+	"remove": object.GetBuiltinByName("remove"),
+	// todo: 网络编程 数据库(用原生的"database/sql")
 }
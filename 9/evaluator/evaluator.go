@@ -4,14 +4,16 @@ package evaluator
 import (
 	"fmt"
 	"malang/ast"
+	"malang/module"
 	"malang/object"
-	"malang/util"
+	"math"
+	"strings"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
 // 求布尔型的值
@@ -24,12 +26,14 @@ func nativeBooleanObject(input bool) *object.Boolean {
 
 // -操作符求值(前缀)
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 // !操作符求值
@@ -59,6 +63,7 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 }
 
 // 解析两侧是数字的正则表达式(eg. 2*2)
+// 整数溢出时按64位二进制补码回绕,除以0返回错误
 func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
@@ -71,11 +76,89 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("modulo by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
+	case "&":
+		return &object.Integer{Value: leftVal & rightVal}
+	case "|":
+		return &object.Integer{Value: leftVal | rightVal}
+	case "^":
+		return &object.Integer{Value: leftVal ^ rightVal}
+	case "<<":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal << uint64(rightVal)}
+	case ">>":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal >> uint64(rightVal)}
+	case "<":
+		return nativeBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// 是否是数字(整数或浮点数)
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+// 数字转为float64,整数会被提升为浮点数
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
+// 解析至少一侧是浮点数的中缀表达式,整数一侧提升为浮点数(eg. 1 + 2.5)
+// 浮点数除以0遵循IEEE 754,得到±Inf或NaN
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
 	case "<":
 		return nativeBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -100,16 +183,13 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right):
+		return evalFloatInfixExpression(operator, left, right)
 	// 这里可以直接对比是因为布尔型都是复用true和false两个对象的指针(地址),可以直接比对地址来看是否相等
 	case operator == "==":
 		return nativeBooleanObject(left == right)
 	case operator == "!=":
 		return nativeBooleanObject(left != right)
-	// todo: && 和 ||
-	case operator == "&&":
-		return nativeBooleanObject(left.(*object.Boolean).Value && right.(*object.Boolean).Value)
-	case operator == "||":
-		return nativeBooleanObject(left.(*object.Boolean).Value || right.(*object.Boolean).Value)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
 	case left.Type() != right.Type():
@@ -119,6 +199,33 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	}
 }
 
+// 解析逻辑运算 && 和 ||(短路求值,右侧只在需要时才求值)
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	switch node.Operator {
+	case "&&":
+		if !isTruthy(left) {
+			return FALSE
+		}
+	case "||":
+		if isTruthy(left) {
+			return TRUE
+		}
+	default:
+		return newError("unknown operator: %s %s", left.Type(), node.Operator)
+	}
+
+	right := Eval(node.Right, env)
+	if isError(right) {
+		return right
+	}
+	return nativeBooleanObject(isTruthy(right))
+}
+
 // if判真策略(真值[true,!false,!null]为成立)
 func isTruthy(obj object.Object) bool {
 	switch obj {
@@ -159,7 +266,7 @@ func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
-		case *object.Error:
+		case *object.Error, *object.Exit:
 			return result
 		}
 	}
@@ -176,7 +283,9 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			// break和continue也需要中断当前块,交给外层的for处理
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.EXIT_OBJ ||
+				rt == object.BREAK || rt == object.CONTINUE {
 				return result
 			}
 		}
@@ -189,12 +298,175 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 	if val, ok := env.Get(node.Value); ok {
 		return val
 	}
-	if builtin, ok := builtins[node.Value]; ok {
+	if builtin, ok := lookupBuiltin(node.Value, env); ok {
 		return builtin
 	}
 	return newError("identifier not found: " + node.Value)
 }
 
+// 查找内置函数,环境设置了注册表时使用注册表中的
+func lookupBuiltin(name string, env *object.Environment) (*object.Builtin, bool) {
+	if r := env.Registry(); r != nil {
+		builtin, _, ok := r.Lookup(name)
+		return builtin, ok
+	}
+	builtin, ok := builtins[name]
+	return builtin, ok
+}
+
+// use导入:模块只执行一次,在独立的环境中求值,
+// 导入方只能通过绑定的模块对象访问导出的绑定
+// 模块加载器和已执行过的模块记录在环境中,见Environment.SetModuleLoader
+func evalUseExpression(node *ast.UseExpression, env *object.Environment) object.Object {
+	modules := env.Modules()
+	path, err := modules.Loader.Resolve(node.FileName, node.Pos())
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	mod, ok := modules.Loaded[path]
+	if !ok {
+		loaded := loadModule(path, env)
+		if isError(loaded) {
+			return loaded
+		}
+		mod = loaded.(*object.Module)
+		modules.Loaded[path] = mod
+	}
+
+	if node.Name != "" {
+		env.Set(node.Name, mod)
+	}
+	return mod
+}
+
+func loadModule(path string, env *object.Environment) object.Object {
+	loader := env.Modules().Loader
+	err := loader.Enter(path)
+	if err != nil {
+		return newError("%s", err)
+	}
+	defer loader.Leave()
+
+	program, err := loader.Parse(path)
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	modEnv := object.NewModuleEnvironment(env)
+	result := Eval(program, modEnv)
+	if isError(result) {
+		return result
+	}
+
+	exported := map[string]bool{}
+	for _, name := range module.Exports(program) {
+		exported[name] = true
+	}
+
+	return &object.Module{
+		Name:    module.Name(path),
+		Exports: module.Exports(program),
+		Lookup: func(name string) (object.Object, bool) {
+			if !exported[name] {
+				return nil, false
+			}
+			return modEnv.Get(name)
+		},
+	}
+}
+
+// 赋值表达式,只能修改已声明的变量
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	if ie, ok := node.Target.(*ast.IndexExpression); ok {
+		return evalIndexAssignExpression(node, ie, env)
+	}
+	ident := node.Target.(*ast.Identifier)
+
+	current, ok := env.Get(ident.Value)
+	if !ok {
+		if _, ok := lookupBuiltin(ident.Value, env); ok {
+			return newError("cannot assign to builtin: %s", ident.Value)
+		}
+		return newError("assignment to undeclared variable: %s", ident.Value)
+	}
+
+	val := Eval(node.Value, env)
+	if isError(val) {
+		return val
+	}
+
+	// 复合赋值 x += 1 等价于 x = x + 1
+	if node.Operator != "=" {
+		val = evalInfixExpression(strings.TrimSuffix(node.Operator, "="), current, val)
+		if isError(val) {
+			return val
+		}
+	}
+
+	env.Assign(ident.Value, val)
+	return val
+}
+
+// 索引赋值 arr[i] = v, h[k] += v,直接修改原数组/哈希
+func evalIndexAssignExpression(node *ast.AssignExpression, ie *ast.IndexExpression, env *object.Environment) object.Object {
+	left := Eval(ie.Left, env)
+	if isError(left) {
+		return left
+	}
+	index := Eval(ie.Index, env)
+	if isError(index) {
+		return index
+	}
+
+	var current object.Object
+	if node.Operator != "=" {
+		current = evalIndexExpression(left, index)
+		if isError(current) {
+			return current
+		}
+	}
+
+	val := Eval(node.Value, env)
+	if isError(val) {
+		return val
+	}
+
+	if node.Operator != "=" {
+		val = evalInfixExpression(strings.TrimSuffix(node.Operator, "="), current, val)
+		if isError(val) {
+			return val
+		}
+	}
+
+	return evalSetIndex(left, index, val)
+}
+
+// 写入数组元素或哈希键值
+func evalSetIndex(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return newError("index out of range: %d (length %d)", i.Value, len(left.Elements))
+		}
+		left.Elements[i.Value] = val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: val}
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+
+	return val
+}
+
 // 对表达式求值
 func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
 	var result []object.Object
@@ -230,19 +502,110 @@ func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Enviro
 }
 
 // 函数体求值
+// 尾调用返回*tailCall,在这里循环执行,调用链不会增长
 func applyFunction(fn object.Object, args []object.Object) object.Object {
-	switch fn := fn.(type) {
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
-	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
-			return result
+	for {
+		switch f := fn.(type) {
+		case *object.Function:
+			extendedEnv := extendFunctionEnv(f, args)
+			evaluated := evalTail(f.Body, extendedEnv)
+			if tc, ok := evaluated.(*tailCall); ok {
+				fn, args = tc.fn, tc.args
+				continue
+			}
+			return unwrapReturnValue(evaluated)
+		case *object.Builtin:
+			if result := f.Fn(args...); result != nil {
+				return result
+			}
+			return NULL
+		default:
+			return newError("not a function: %s", fn.Type())
+		}
+	}
+}
+
+// 处于尾部位置的函数调用,由applyFunction执行
+type tailCall struct {
+	fn   *object.Function
+	args []object.Object
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string         { return "tail call" }
+
+// 对函数体中处于尾部位置的节点求值,其中的函数调用不直接执行而是返回*tailCall
+// 尾部位置: 函数体的最后一条语句、return的值、尾部if的两个分支
+func evalTail(node ast.Node, env *object.Environment) object.Object {
+	obj := evalTailNode(node, env)
+
+	// 与Eval一样记录错误位置
+	if err, ok := obj.(*object.Error); ok && !err.Pos.IsValid() && node != nil {
+		err.Pos = node.Pos()
+	}
+
+	return obj
+}
+
+func evalTailNode(node ast.Node, env *object.Environment) object.Object {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		var result object.Object
+
+		for i, statement := range node.Statements {
+			if _, ok := statement.(*ast.ReturnStatement); ok || i == len(node.Statements)-1 {
+				return evalTail(statement, env)
+			}
+
+			result = Eval(statement, env)
+			if result != nil {
+				rt := result.Type()
+				if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.EXIT_OBJ ||
+					rt == object.BREAK || rt == object.CONTINUE {
+					return result
+				}
+			}
+		}
+		return result
+	case *ast.ExpressionStatement:
+		return evalTail(node.Expression, env)
+	case *ast.ReturnStatement:
+		val := evalTail(node.ReturnValue, env)
+		if isError(val) {
+			return val
+		}
+		if _, ok := val.(*tailCall); ok {
+			return val
+		}
+		return &object.ReturnValue{Value: val}
+	case *ast.IfExpression:
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+
+		if isTruthy(condition) {
+			return evalTail(node.Consequence, env)
+		} else if node.Alternative != nil {
+			return evalTail(node.Alternative, env)
 		}
 		return NULL
+	case *ast.CallExpression:
+		function := Eval(node.Function, env)
+		if isError(function) {
+			return function
+		}
+		args := evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+
+		if fn, ok := function.(*object.Function); ok {
+			return &tailCall{fn: fn, args: args}
+		}
+		return applyFunction(function, args)
 	default:
-		return newError("not a function: %s", fn.Type())
+		return Eval(node, env)
 	}
 }
 
@@ -295,6 +658,12 @@ func evalIndexExpression(left, index object.Object) object.Object {
 		return evalHashIndexExpression(left, index)
 	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalStringIndexExpression(left, index)
+	case left.Type() == object.MODULE_OBJ && index.Type() == object.STRING_OBJ:
+		val, err := left.(*object.Module).Member(index.(*object.String).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return val
 	default:
 		return newError("index operator not supported: %s", left.Type())
 	}
@@ -327,24 +696,92 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 	return &object.Hash{Pairs: pairs}
 }
 
-// 对for循环体进行求值
-func evalForBodyStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
-	var result object.Object
+// for循环求值
+func evalForExpression(fe *ast.ForExpression, env *object.Environment) object.Object {
+	for {
+		condition := Eval(fe.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			break
+		}
 
-	for _, statement := range block.Statements {
-		result = Eval(statement, env)
+		result := Eval(fe.Body, env)
+		if result == nil {
+			continue
+		}
 
-		if result != nil {
-			rt := result.Type()
-			if rt == object.BREAK || rt == object.CONTINUE || rt == object.ERROR_OBJ {
-				return result
+		// break跳出循环,continue进入下一轮,return和error继续向外冒泡
+		rt := result.Type()
+		if rt == object.BREAK {
+			break
+		}
+		if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.EXIT_OBJ {
+			return result
+		}
+	}
+	return NULL
+}
+
+// try表达式求值
+// 块中产生的错误(包括throw和运行时错误)交给catch处理,exit()不能被捕获
+// finally总会执行,如果finally中发生了return、break、错误等中断,则覆盖之前的结果
+func evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := Eval(te.Block, env)
+
+	if err, ok := result.(*object.Error); ok && te.Catch != nil {
+		if te.Param != nil {
+			env.Set(te.Param.Value, exceptionValue(err))
+		}
+		result = Eval(te.Catch, env)
+	}
+
+	// exit()立即结束程序,不执行finally(与虚拟机一致)
+	if _, ok := result.(*object.Exit); ok {
+		return result
+	}
+
+	if te.Finally != nil {
+		final := Eval(te.Finally, env)
+		if final != nil {
+			switch final.Type() {
+			case object.ERROR_OBJ, object.EXIT_OBJ, object.RETURN_VALUE_OBJ, object.BREAK, object.CONTINUE:
+				return final
 			}
 		}
 	}
+
+	if result == nil {
+		return NULL
+	}
 	return result
 }
 
+// catch绑定的值:throw抛出的值,运行时错误则是错误信息字符串
+func exceptionValue(err *object.Error) object.Object {
+	if err.Thrown != nil {
+		return err.Thrown
+	}
+	return &object.String{Value: err.Message}
+}
+
+func newThrownError(val object.Object) *object.Error {
+	return &object.Error{Message: "uncaught exception: " + val.Inspect(), Thrown: val}
+}
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	obj := eval(node, env)
+
+	// 由最内层产生错误的节点记录位置,外层节点不再覆盖
+	if err, ok := obj.(*object.Error); ok && !err.Pos.IsValid() && node != nil {
+		err.Pos = node.Pos()
+	}
+
+	return obj
+}
+
+func eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	// 语句 -> 继续遍历
 	// 根节点
@@ -352,26 +789,10 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalProgram(node, env)
 	// use导入语句
 	case *ast.UseExpression:
-		// 解析
-		return Eval(util.LoadMalFile(node.FileName), env)
-		// for语句
+		return evalUseExpression(node, env)
+	// for语句
 	case *ast.ForExpression:
-		var condition object.Object
-		for isTruthy(condition) {
-			// fmt.Println(condition)
-			condition = Eval(node.Condition, env)
-			// 模仿blockStatement的解析,创建一个解析for块语句的函数
-			// 在其中添加break和continue的流程控制(遇到就return break或continue标识)
-			ctrl := evalForBodyStatement(node.Body, env)
-			// fmt.Println(ctrl.Type())
-			if ctrl.Type() == object.BREAK {
-				break
-			}
-			if ctrl.Type() == object.CONTINUE {
-				continue
-			}
-		}
-		return &object.Null{}
+		return evalForExpression(node, env)
 	case *ast.ContinueExpression:
 		return &object.Continue{}
 	case *ast.BreakExpression:
@@ -390,6 +811,8 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	// 标识符
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
 	// 函数语句
 	case *ast.FunctionLiteral:
 		params := node.Parameters
@@ -408,6 +831,16 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 		return applyFunction(function, args)
 	// Return语句
+	// throw语句
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return newThrownError(val)
+	// try表达式
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
 	case *ast.ReturnStatement:
 		// 对返回值进行求值
 		val := Eval(node.ReturnValue, env)
@@ -436,6 +869,9 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	// 表达式 -> 求值
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	// 浮点数
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	// 布尔型
 	case *ast.Boolean:
 		return nativeBooleanObject(node.Value)
@@ -463,6 +899,10 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalPrefixExpression(node.Operator, right)
 		// 中缀表达式
 	case *ast.InfixExpression:
+		// 逻辑运算需要短路,不能先对两侧都求值
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
 		left := Eval(node.Left, env)
 		// 判断该中断是不是Error引发的
 		if isError(left) {
@@ -482,9 +922,10 @@ func newError(format string, args ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, args...)}
 }
 
+// exit()和错误一样中断求值,一直传递到最外层
 func isError(obj object.Object) bool {
 	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
+		return obj.Type() == object.ERROR_OBJ || obj.Type() == object.EXIT_OBJ
 	}
 	return false
 }
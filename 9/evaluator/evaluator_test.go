@@ -1,9 +1,15 @@
 package evaluator
 
 import (
+	"fmt"
 	"malang/lexer"
+	"malang/module"
+	"malang/module/moduletest"
 	"malang/object"
 	"malang/parser"
+	"math"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -373,6 +379,14 @@ func TestHashIndexExpression(t *testing.T) {
 			`{false: 5}[false]`,
 			5,
 		},
+		{
+			`{1: 5}[1.0]`,
+			5,
+		},
+		{
+			`{2.0: 5}[2]`,
+			5,
+		},
 	}
 	for _, tt := range ts {
 		eval := testEval(tt.input)
@@ -399,6 +413,8 @@ func TestErrorHandling(t *testing.T) {
 		{`"hello" - "world`, "unknown operator: STRING - STRING"},
 		{`{"name": "Monkey"}[fn(x) {x}];`, "unusable as hash key: FUNCTION"},
 		{"if (10 > 1) {false+false;} return 1;}", "unknown operator: BOOLEAN + BOOLEAN"},
+		{"1 / 0", "division by zero"},
+		{"let f = fn(a) { 10 / a }; f(0); 5", "division by zero"},
 	}
 	for _, tt := range ts {
 		eval := testEval(tt.input)
@@ -413,3 +429,622 @@ func TestErrorHandling(t *testing.T) {
 		}
 	}
 }
+
+func TestForExpression(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"for (false) { 1 }", nil},
+		{"let i = 0; for (i < 5) { let i = i + 1; }; i", 5},
+		{"let i = 0; for (true) { let i = i + 1; if (i > 3) { break; } }; i", 4},
+		{"let i = 0; let sum = 0; for (i < 10) { let i = i + 1; if (i > 5) { continue; } let sum = sum + i; }; sum", 15},
+		{"let f = fn() { let i = 0; for (true) { let i = i + 1; if (i == 3) { return i * 10; } } }; f()", 30},
+	}
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, eval, int64(integer))
+		} else {
+			testNullObject(t, eval)
+		}
+	}
+}
+
+func TestLogicalExpressions(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected bool
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || true", true},
+		{"true || false", true},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"1 && \"a\"", true},
+		{"if (false) { 1 } || 0", true},
+		{"true || false && false", true},
+		// 短路:右侧不会被求值,否则会产生错误
+		{"false && (1 + true)", false},
+		{"true || (1 + true)", true},
+	}
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		testBooleanObject(t, eval, tt.expected)
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string
+	}{
+		{"5 + true;", "ERROR: test.mal:1:1: type mismatch: INTEGER + BOOLEAN"},
+		{"let x = 1;\nlet y = x + foobar;", "ERROR: test.mal:2:13: identifier not found: foobar"},
+		{"let f = fn() {\n  -true\n};\nf();", "ERROR: test.mal:2:3: unknown operator: -BOOLEAN"},
+		{"len(1, 2)", "ERROR: test.mal:1:1: wrong number of arguments. got=2, want=1"},
+	}
+	for _, tt := range ts {
+		l := lexer.NewWithFile("test.mal", tt.input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		eval := Eval(program, object.NewEnvironment())
+
+		errobj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("no error obj returned. got=%T(%+v)", eval, eval)
+			continue
+		}
+		if errobj.Inspect() != tt.expected {
+			t.Errorf("wrong error: expected=%q, got=%q", tt.expected, errobj.Inspect())
+		}
+	}
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	res, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("obj is not float. got=%T (%+v)", obj, obj)
+		return false
+	}
+	if res.Value != expected {
+		t.Errorf("obj has wrong val. got=%g, want=%g", res.Value, expected)
+		return false
+	}
+	return true
+}
+
+func TestEvalFloatExpression(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"3.14", 3.14},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"1e-3 * 1000", 1.0},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"2 == 2.0", true},
+		{"2.5 != 2.5", false},
+		{"float(3)", 3.0},
+		{`float("2.25")`, 2.25},
+		{"int(3.9)", 3},
+		{"int(-3.9)", -3},
+		{`int("42")`, 42},
+		{"let avg = fn(a, b) { (a + b) / 2.0 }; avg(1, 2)", 1.5},
+	}
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case float64:
+			testFloatObject(t, eval, expected)
+		case int:
+			testIntegerObject(t, eval, int64(expected))
+		case bool:
+			testBooleanObject(t, eval, expected)
+		}
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string
+	}{
+		{`int("abc")`, `could not convert "abc" to INTEGER`},
+		{`float("1.2.3")`, `could not convert "1.2.3" to FLOAT`},
+		{`int([1])`, "argument to `int` not supported, got ARRAY"},
+		{`float(1, 2)`, "wrong number of arguments. got=2, want=1"},
+	}
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		errobj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("obj is not error. got=%T (%+v)", eval, eval)
+			continue
+		}
+		if errobj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errobj.Message)
+		}
+	}
+}
+
+func TestIntegerOverflowWraps(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected int64
+	}{
+		{"9223372036854775807 + 1", math.MinInt64},
+		{"-9223372036854775807 - 2", math.MaxInt64},
+		{"4611686018427387904 * 2", math.MinInt64},
+	}
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		testIntegerObject(t, eval, tt.expected)
+	}
+}
+
+func TestOperatorSuite(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"7 % 3", 7 % 3},
+		{"-7 % 3", -7 % 3},
+		{"7.5 % 2", 1.5},
+		{"6 & 3", 6 & 3},
+		{"6 | 3", 6 | 3},
+		{"6 ^ 3", 6 ^ 3},
+		{"1 << 10", 1 << 10},
+		{"1024 >> 3", 1024 >> 3},
+		{"-8 >> 1", -8 >> 1},
+		{"1 + 6 & 3", 1 + 6&3},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"2.5 >= 2", true},
+		{"1.5 <= 1", false},
+		{"10 % 4 == 2 && 1 <= 1", true},
+	}
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, eval, int64(expected))
+		case float64:
+			testFloatObject(t, eval, expected)
+		case bool:
+			testBooleanObject(t, eval, expected)
+		}
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 % 0", "modulo by zero"},
+		{"1 << -1", "negative shift count: -1"},
+		{"1.5 & 1", "unknown operator: FLOAT & INTEGER"},
+	}
+	for _, tt := range errorTests {
+		eval := testEval(tt.input)
+		errobj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("obj is not error. got=%T (%+v)", eval, eval)
+			continue
+		}
+		if errobj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errobj.Message)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 10; x += 5; x", 15},
+		{"let x = 10; x -= 5; x", 5},
+		{"let x = 10; x *= 5; x", 50},
+		{"let x = 10; x /= 5; x", 2},
+		{"let a = 0; let b = 0; a = b = 7; a + b", 14},
+		{"let i = 0; for (i < 5) { i += 1 }; i", 5},
+		// 函数内修改外层变量
+		{"let x = 1; let f = fn() { x = x + 1 }; f(); f(); x", 3},
+		// 同名参数遮蔽外层变量,赋值只修改参数
+		{"let x = 1; let f = fn(x) { x = 10 }; f(5); x", 1},
+		{`
+let newCounter = fn() {
+	let count = 0;
+	fn() { count += 1 }
+};
+let counterA = newCounter();
+let counterB = newCounter();
+counterA(); counterA(); counterB();
+counterA() * 10 + counterB()`, 32},
+	}
+
+	for _, tt := range ts {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestAssignErrors(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 1", "assignment to undeclared variable: x"},
+		{"let f = fn() { y += 1 }; f()", "assignment to undeclared variable: y"},
+		{"len = 1", "cannot assign to builtin: len"},
+		{`let x = 1; x += "a"`, "type mismatch: INTEGER + STRING"},
+	}
+
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		errobj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("obj is not error. got=%T (%+v)", eval, eval)
+			continue
+		}
+		if errobj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errobj.Message)
+		}
+	}
+}
+
+func TestIndexAssignExpressions(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = [1, 2, 3]; a[0] = 10; a[0]", 10},
+		{"let a = [1, 2, 3]; a[2] = 5", 5},
+		{"let a = [1, 2, 3]; a[1] += 5; a[1]", 7},
+		{"let a = [[1, 2], [3, 4]]; a[1][0] *= 10; a[1][0]", 30},
+		{`let h = {"a": 1}; h["a"] = 2; h["a"]`, 2},
+		{`let h = {}; h["b"] = 3; h["b"]`, 3},
+		{`let h = {"n": 1}; h["n"] -= 3; h["n"]`, -2},
+		{`let h = {}; h[true] = 1; h[1] = 2; h[true] + h[1]`, 3},
+		// 数组是引用,函数内的修改对外可见
+		{"let a = [0]; let f = fn(arr) { arr[0] = 9 }; f(a); a[0]", 9},
+		{"let a = [0, 0, 0]; let i = 0; for (i < 3) { a[i] = i * i; i += 1 }; a[2]", 4},
+	}
+
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		testIntegerObject(t, eval, int64(tt.expected.(int)))
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [1]; a[1] = 2", "index out of range: 1 (length 1)"},
+		{"let a = [1]; a[-1] = 2", "index out of range: -1 (length 1)"},
+		{`let a = [1]; a["x"] = 2`, "array index must be INTEGER, got STRING"},
+		{`let h = {}; h[fn() {}] = 1`, "unusable as hash key: FUNCTION"},
+		{`let s = "abc"; s[0] = "x"`, "index assignment not supported: STRING"},
+		{"let a = [1]; a[0] += true", "type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range errorTests {
+		eval := testEval(tt.input)
+		errobj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("obj is not error. got=%T (%+v)", eval, eval)
+			continue
+		}
+		if errobj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errobj.Message)
+		}
+	}
+}
+
+// 在临时目录中写入模块文件,返回目录路径
+func TestUseExpression(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"main.mal":       "",
+		"mathx.mal":      "let secret = 2;\nexport let double = fn(x) { x * secret };\nexport let two = secret;",
+		"counter.mal":    "let count = 0;\nexport let inc = fn() { count += 1 };\nexport let get = fn() { count };",
+		"live.mal":       "export let n = 0;\nexport let bump = fn() { n += 1 };",
+		"sub/helper.mal": "use leaf;\nexport let helper = fn() { leaf.value + 1 };",
+		"sub/leaf.mal":   "export let value = 41;",
+		"cyclea.mal":     "use cycleb;",
+		"cycleb.mal":     "use cyclea;",
+		"usesfn.mal":     "export let f = fn() { use mathx as m; m.double(5) };",
+		"boom.mal":       "export let boom = fn() {\n\t1 / 0\n};",
+		"legacy.mal":     "puts(1);",
+	})
+
+	evalIn := func(env *object.Environment, input string) object.Object {
+		l := lexer.NewWithFile(filepath.Join(dir, "main.mal"), input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %q", p.Errors())
+		}
+		return Eval(program, env)
+	}
+	newEnv := func() *object.Environment {
+		env := object.NewEnvironment()
+		env.SetModuleLoader(module.NewLoader([]string{filepath.Join(dir, "sub")}))
+		return env
+	}
+	testUse := func(input string) object.Object {
+		return evalIn(newEnv(), input)
+	}
+
+	ts := []struct {
+		input    string
+		expected int64
+	}{
+		{"use mathx; mathx.double(21)", 42},
+		{"use mathx as m; m.double(21)", 42},
+		{`use mathx; mathx["two"]`, 2},
+		// 模块有独立的命名空间,同名绑定互不覆盖
+		{"let double = 1; use mathx; double + mathx.double(1)", 3},
+		{"let secret = 5; use mathx; mathx.double(1) + secret", 7},
+		// 模块只执行一次,两个别名指向同一个模块
+		{"use counter as a; use counter as b; a.inc(); b.inc(); a.get()", 2},
+		// 模块内部修改导出的变量,外部读到的是当前值
+		{"use live; live.bump(); live.bump(); live.n", 2},
+		{`use live; live.bump(); live["n"]`, 1},
+		// helper在搜索路径中,它导入的leaf相对于helper所在目录解析
+		{"use helper; helper.helper()", 42},
+		{"use usesfn; usesfn.f()", 10},
+		// 模块对象可以作为值传递
+		{`use mathx as m; let g = fn(mod) { mod["double"](4) }; g(m)`, 8},
+		{"let h = {\"a\": 1}; h.a = h.a + 1; h.a", 2},
+	}
+
+	for _, tt := range ts {
+		testIntegerObject(t, testUse(tt.input), tt.expected)
+	}
+
+	mod, ok := testUse("use mathx").(*object.Module)
+	if !ok {
+		t.Fatalf("use did not return a module")
+	}
+	if mod.Inspect() != "module mathx {double, two}" {
+		t.Errorf("wrong module. got=%q", mod.Inspect())
+	}
+	// 没有导出的模块也返回模块对象
+	if _, ok := testUse("use legacy").(*object.Module); !ok {
+		t.Errorf("use did not return a module")
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"use nope", "module not found: nope.mal"},
+		{"use cyclea", "import cycle: "},
+		{"use mathx; secret", "identifier not found: secret"},
+		{"use mathx; mathx.secret", "module mathx has no exported member secret"},
+		{"use mathx; mathx.two = 3", "index assignment not supported: MODULE"},
+		{"use boom; boom.boom()", "division by zero"},
+	}
+
+	for _, tt := range errorTests {
+		eval := testUse(tt.input)
+		errobj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("obj is not error. got=%T (%+v)", eval, eval)
+			continue
+		}
+		if !strings.HasPrefix(errobj.Message, tt.expected) {
+			t.Errorf("wrong error message. want prefix %q, got=%q", tt.expected, errobj.Message)
+		}
+	}
+
+	// 已加载的模块记录在环境中:同一个环境多次求值共享模块,不同环境互不影响
+	env := newEnv()
+	evalIn(env, "use counter; counter.inc()")
+	testIntegerObject(t, evalIn(env, "use counter; counter.inc()"), 2)
+	testIntegerObject(t, evalIn(newEnv(), "use counter; counter.inc()"), 1)
+	testIntegerObject(t, evalIn(env, "let f = fn() { use counter as c; c.get() }; f()"), 2)
+
+	// 运行时错误的位置指向模块文件
+	eval := testUse("use boom; boom.boom()")
+	if errobj, ok := eval.(*object.Error); ok {
+		want := filepath.Join(dir, "boom.mal") + ":2:2"
+		if errobj.Pos.String() != want {
+			t.Errorf("wrong error position. want=%q, got=%q", want, errobj.Pos)
+		}
+	}
+}
+
+func TestScriptBuiltins(t *testing.T) {
+	t.Setenv("MALANG_TEST_VAR", "hello")
+
+	// 命令行参数随环境的注册表传入
+	r := object.NewRegistry()
+	r.SetArgs([]string{"in.txt", "-v"})
+
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`len(args())`, 2},
+		{`args()[0]`, "in.txt"},
+		{`args()[1]`, "-v"},
+		{`let f = fn() { args() }; len(f())`, 2},
+		{`getenv("MALANG_TEST_VAR")`, "hello"},
+		{`getenv("MALANG_TEST_UNSET_VAR")`, nil},
+	}
+
+	for _, tt := range ts {
+		env := object.NewEnvironment()
+		env.SetRegistry(r)
+		eval := Eval(parser.New(lexer.New(tt.input)).ParseProgram(), env)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, eval, int64(expected))
+		case string:
+			str, ok := eval.(*object.String)
+			if !ok {
+				t.Errorf("obj is not String. got=%T (%+v)", eval, eval)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value. want=%q, got=%q", expected, str.Value)
+			}
+		default:
+			testNullObject(t, eval)
+		}
+	}
+
+	// 没有设置注册表时为空数组
+	testIntegerObject(t, testEval(`len(args())`), 0)
+}
+
+func TestExit(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`exit(); 1`, 0},
+		{`exit(3); 1`, 3},
+		{`let f = fn(n) { if (n > 2) { exit(n) }; n }; let i = 0; for (i < 10) { f(i); i += 1 }; 99`, 3},
+		{`let f = fn() { exit(4) }; [1, f(), 2]`, 4},
+		{`exit("a")`, "argument to `exit` must be INTEGER. got STRING"},
+		{`exit(256)`, "exit code out of range: 256"},
+	}
+
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			exit, ok := eval.(*object.Exit)
+			if !ok {
+				t.Errorf("obj is not Exit. got=%T (%+v)", eval, eval)
+				continue
+			}
+			if exit.Code != expected {
+				t.Errorf("wrong exit code. want=%d, got=%d", expected, exit.Code)
+			}
+		case string:
+			errobj, ok := eval.(*object.Error)
+			if !ok {
+				t.Errorf("obj is not error. got=%T (%+v)", eval, eval)
+				continue
+			}
+			if errobj.Message != expected {
+				t.Errorf("wrong error message. want=%v, got=%v", expected, errobj.Message)
+			}
+		}
+	}
+}
+
+func TestFileBuiltins(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"lines.txt": "a\nb\n",
+	})
+	path := filepath.Join(dir, "lines.txt")
+	out := filepath.Join(dir, "out.txt")
+
+	ts := []struct {
+		input    string
+		expected string // Inspect()的结果
+	}{
+		{fmt.Sprintf(`read_lines(%q)`, path), "[a, b]"},
+		{fmt.Sprintf(`exists(%q) == true`, path), "true"},
+		{fmt.Sprintf(`write_file(%q, "x"); append_file(%q, "y"); read_file(%q)`, out, out, out), "xy"},
+		{fmt.Sprintf(`list_dir(%q)`, dir), "[lines.txt, out.txt]"},
+		{fmt.Sprintf(`remove(%q); exists(%q)`, out, out), "false"},
+		{fmt.Sprintf(`read_file(%q)`, out), "ERROR: 1:1: read_file: open " + out + ": no such file or directory"},
+	}
+
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		if eval.Inspect() != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.input, tt.expected, eval.Inspect())
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string // Inspect()的结果
+	}{
+		{`try { 1 } catch (e) { 2 }`, "1"},
+		{`try { throw 1; 2 } catch (e) { e + 10 }`, "11"},
+		{`try { throw "x" } catch { 2 }`, "2"},
+		{`try { 1 / 0 } catch (e) { e }`, "division by zero"},
+		{`let f = fn(x) { if (x > 2) { throw [x] }; x }; try { f(1) + f(5) } catch (e) { e }`, "[5]"},
+		{`let n = 0; try { n = 1 } finally { n = n + 1 }; n`, "2"},
+		{`let n = 0; let r = try { throw 1 } catch (e) { n = 1; 5 } finally { n = n + 1 }; [r, n]`, "[5, 2]"},
+		{`let n = 0; let f = fn() { try { return 1 } finally { n = 2 } }; [f(), n]`, "[1, 2]"},
+		{`let f = fn() { try { return 1 } finally { return 2 } }; f()`, "2"},
+		{`let n = 0; let i = 0; for (i < 5) { i += 1; try { if (i == 3) { break } } finally { n += 1 } }; [i, n]`, "[3, 3]"},
+		{`try { try { throw 1 } finally { 2 } } catch (e) { e }`, "1"},
+		{`try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e }`, "2"},
+		{`try { } catch (e) { 1 }`, "null"},
+		{`throw {"a": 1}`, "ERROR: 1:1: uncaught exception: {a: 1}"},
+		{`try { 1 } finally { throw 2 }`, "ERROR: 1:21: uncaught exception: 2"},
+		{`try { exit(3) } catch (e) { 1 }`, "exit(3)"},
+		// 内置函数的错误可以被捕获
+		{`try { read_file("/nonexistent/x") } catch (e) { "caught" }`, "caught"},
+		{`try { len(1, 2) } catch (e) { e }`, "wrong number of arguments. got=2, want=1"},
+	}
+
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		if eval.Inspect() != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.input, tt.expected, eval.Inspect())
+		}
+	}
+
+	// exit()立即结束程序,不执行finally
+	exits := []string{
+		`let n = 0; try { exit(3) } catch (e) { 1 } finally { n = 1 }`,
+		`let n = 0; try { throw 1 } catch (e) { exit(3) } finally { n = 1 }`,
+	}
+	for _, input := range exits {
+		env := object.NewEnvironment()
+		eval := Eval(parser.New(lexer.New(input)).ParseProgram(), env)
+		if exit, ok := eval.(*object.Exit); !ok || exit.Code != 3 {
+			t.Errorf("%s: expected exit(3), got=%s", input, eval.Inspect())
+		}
+		if n, _ := env.Get("n"); n.Inspect() != "0" {
+			t.Errorf("%s: finally ran on exit", input)
+		}
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string // Inspect()的结果
+	}{
+		{`let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + n) } }; f(100000, 0)`, "5000050000"},
+		{`let f = fn(n) { if (n == 0) { return "done" }; return f(n - 1) }; f(100000)`, "done"},
+		{`let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; even(100001)`, "false"},
+		{`let f = fn(n) { if (n == 0) { len("abc") } else { f(n - 1) } }; f(10)`, "3"},
+		{`let f = fn(n) { if (n == 0) { 1 + true } else { f(n - 1) } }; f(10)`, "ERROR: 1:31: type mismatch: INTEGER + BOOLEAN"},
+		{`let f = fn() { let x = 1; len(x) }; f()`, "ERROR: 1:27: argument to `len` not supported, got INTEGER"},
+		{`let f = fn(n) { if (n == 0) { return 1 }; 2 }; [f(0), f(1)]`, "[1, 2]"},
+	}
+
+	for _, tt := range ts {
+		eval := testEval(tt.input)
+		if eval.Inspect() != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.input, tt.expected, eval.Inspect())
+		}
+	}
+}
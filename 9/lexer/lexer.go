@@ -10,17 +10,38 @@ type Lexer struct {
 	position     int  // 输入的字符串中的当前位置(指向当前字符)
 	readPosition int  // 输入的字符串中的当前读取位置(指向当前字符串之后的一个字符(ch))
 	ch           byte // 当前正在查看的字符
+
+	file   string // 源文件名
+	line   int    // 当前字符所在行
+	column int    // 当前字符所在列
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFile("", input)
+}
+
+// 创建词法分析器,并记录源文件名(用于错误信息中的位置)
+func NewWithFile(file string, input string) *Lexer {
+	l := &Lexer{input: input, file: file, line: 1}
 	// 初始化 l.ch,l.position,l.readPosition
 	l.readChar()
 	return l
 }
 
+// 当前字符的位置
+func (l *Lexer) pos() token.Position {
+	return token.Position{File: l.file, Line: l.line, Column: l.column}
+}
+
 // 读取下一个字符
 func (l *Lexer) readChar() {
+	// 跨过换行符进入下一行
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0 // NUL的ASSII码(0)
 	} else {
@@ -67,14 +88,41 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-// 读取数字
-func (l *Lexer) readNumber() string {
+// 读取数字,返回字面量和类型(整数或浮点数)
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	// 记录起始位置
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
+
+	// 小数部分,点后面必须是数字(3.14)
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		for isDigit(l.ch) {
+			l.readChar()
+		}
+	}
+
+	// 指数部分(1e9, 1e-9, 2.5E+3)
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if isDigit(next) || ((next == '+' || next == '-') && isDigit(l.peekCharN(2))) {
+			tokenType = token.FLOAT
+			l.readChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			for isDigit(l.ch) {
+				l.readChar()
+			}
+		}
+	}
+
+	return l.input[position:l.position], tokenType
 }
 
 // 向前查看一个字符,但是不移动指针
@@ -86,6 +134,14 @@ func (l *Lexer) peekChar() byte {
 	}
 }
 
+// 向前查看第n个字符(n为1时等同于peekChar),不移动指针
+func (l *Lexer) peekCharN(n int) byte {
+	if l.position+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.position+n]
+}
+
 func (l *Lexer) readString() string {
 	position := l.position + 1
 	for {
@@ -116,6 +172,8 @@ func (l *Lexer) NextToken() token.Token {
 	// 跳过空格
 	l.skipWhitespace()
 
+	pos := l.pos()
+
 	switch l.ch {
 	case '"':
 		tok.Type = token.STRING
@@ -128,8 +186,7 @@ func (l *Lexer) NextToken() token.Token {
 			literal := string(ch) + string(l.ch)
 			tok = token.Token{Type: token.AND, Literal: literal}
 		} else {
-			// 未知符合 &
-			tok = newToken(token.ILLEGAL, l.ch)
+			tok = newToken(token.BIT_AND, l.ch)
 		}
 	case '|':
 		if l.peekChar() == '|' {
@@ -139,8 +196,7 @@ func (l *Lexer) NextToken() token.Token {
 			literal := string(ch) + string(l.ch)
 			tok = token.Token{Type: token.OR, Literal: literal}
 		} else {
-			// 未知符号 |
-			tok = newToken(token.ILLEGAL, l.ch)
+			tok = newToken(token.BIT_OR, l.ch)
 		}
 	case '=':
 		if l.peekChar() == '=' {
@@ -153,9 +209,19 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.PLUS_ASSIGN, Literal: "+="}
+		} else {
+			tok = newToken(token.PLUS, l.ch)
+		}
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.MINUS_ASSIGN, Literal: "-="}
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 	case '!':
 		if l.peekChar() == '=' {
 			// 记录当前ch (!)
@@ -171,15 +237,47 @@ func (l *Lexer) NextToken() token.Token {
 			l.readChar()               // 跳过 /
 			literal := l.readComment() // 读取注释内容
 			tok = token.Token{Type: token.COMMENT, Literal: literal}
+		} else if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.SLASH_ASSIGN, Literal: "/="}
 		} else {
 			tok = newToken(token.SLASH, l.ch)
 		}
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.ASTERISK_ASSIGN, Literal: "*="}
+		} else {
+			tok = newToken(token.ASTERISK, l.ch)
+		}
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		// < <= <<
+		switch l.peekChar() {
+		case '=':
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: "<="}
+		case '<':
+			l.readChar()
+			tok = token.Token{Type: token.SHL, Literal: "<<"}
+		default:
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		// > >= >>
+		switch l.peekChar() {
+		case '=':
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: ">="}
+		case '>':
+			l.readChar()
+			tok = token.Token{Type: token.SHR, Literal: ">>"}
+		default:
+			tok = newToken(token.GT, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ':':
@@ -194,6 +292,8 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
 		tok = newToken(token.RBRACE, l.ch)
+	case '.':
+		tok = newToken(token.DOT, l.ch)
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
@@ -205,17 +305,19 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Pos = pos
 			// 因为readIdentifier会调用readChar,所以提前return,不需要后面再readChar
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Literal, tok.Type = l.readNumber()
+			tok.Pos = pos
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
 
+	tok.Pos = pos
 	l.readChar()
 	return tok
 }
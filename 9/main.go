@@ -2,12 +2,19 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"malang/compiler"
+	"malang/module"
+	"malang/object"
 	"malang/repl"
+	"malang/vm"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
 )
 
 type Cmd struct {
@@ -15,12 +22,18 @@ type Cmd struct {
 	versionFlag bool
 	replFlag    bool // 控制台程序
 	cpOption    string
+	pathOption  string // use的模块搜索路径
+	engine      string // 执行文件所用的引擎: vm或eval
+	noOptimize  bool   // 关闭字节码优化
 	malFile     string // 待编译的文件
 	args        []string
 }
 
 func printUsage() {
 	fmt.Printf("Usage: %s [-options] [args...]\n", os.Args[0])
+	fmt.Printf("       %s build [-o out.malc] [-strip] file.mal\n", os.Args[0])
+	fmt.Printf("       %s run file.malc|file.mal [args...]\n", os.Args[0])
+	fmt.Printf("       %s disasm file.mal|file.malc\n", os.Args[0])
 }
 func parseCmd() *Cmd {
 	cmd := &Cmd{}
@@ -31,6 +44,9 @@ func parseCmd() *Cmd {
 	flag.BoolVar(&cmd.versionFlag, "v", false, "print version and exit")
 	flag.StringVar(&cmd.cpOption, "filepath", "", "filepath")
 	flag.StringVar(&cmd.cpOption, "f", "", "filepath")
+	flag.StringVar(&cmd.pathOption, "path", os.Getenv("MALANG_PATH"), "module search path (defaults to $MALANG_PATH)")
+	flag.StringVar(&cmd.engine, "engine", "vm", "use 'vm' or 'eval' to run files")
+	flag.BoolVar(&cmd.noOptimize, "no-opt", false, "disable bytecode optimizations")
 	flag.Parse()
 
 	args := flag.Args()
@@ -41,28 +57,197 @@ func parseCmd() *Cmd {
 	}
 	return cmd
 }
-func main() {
-	user, err := user.Current()
+
+// malang build [-o out.malc] [-strip] file.mal
+// 编译为.malc字节码文件
+func buildCmd(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	output := fs.String("o", "", "output file (defaults to the input file with a .malc extension)")
+	strip := fs.Bool("strip", false, "omit debug info (function names and source positions)")
+	path := fs.String("path", os.Getenv("MALANG_PATH"), "module search path (defaults to $MALANG_PATH)")
+	noOptimize := fs.Bool("no-opt", false, "disable bytecode optimizations")
+	fs.Parse(args)
+	repl.SetOptimize(!*noOptimize)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s build [-o out.malc] [-strip] file.mal\n", os.Args[0])
+		return 2
+	}
+	file := fs.Arg(0)
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	bytecode, err := repl.CompileFile(file, string(buf), module.SplitSearchPath(*path))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(file, filepath.Ext(file)) + ".malc"
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer out.Close()
+
+	err = compiler.Encode(out, bytecode, !*strip)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// malang run file.malc|file.mal [args...]
+// 在虚拟机中执行.malc字节码文件,源文件会先编译
+func runCmd(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	path := fs.String("path", os.Getenv("MALANG_PATH"), "module search path (defaults to $MALANG_PATH)")
+	noOptimize := fs.Bool("no-opt", false, "disable bytecode optimizations")
+	fs.Parse(args)
+	repl.SetOptimize(!*noOptimize)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s run file.malc|file.mal [args...]\n", os.Args[0])
+		return 2
+	}
+	file := fs.Arg(0)
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var bytecode *compiler.Bytecode
+	if filepath.Ext(file) == ".malc" {
+		bytecode, err = compiler.Decode(bytes.NewReader(buf))
+	} else {
+		bytecode, err = repl.CompileFile(file, string(buf), module.SplitSearchPath(*path))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return 1
+	}
+
+	return exitCode(repl.RunBytecode(bytecode, fs.Args()[1:]))
+}
+
+// malang disasm file.mal|file.malc
+// 输出编译得到的字节码,包括常量池中的所有函数
+func disasmCmd(args []string) int {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	path := fs.String("path", os.Getenv("MALANG_PATH"), "module search path (defaults to $MALANG_PATH)")
+	noOptimize := fs.Bool("no-opt", false, "disable bytecode optimizations")
+	fs.Parse(args)
+	repl.SetOptimize(!*noOptimize)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s disasm file.mal|file.malc\n", os.Args[0])
+		return 2
+	}
+	file := fs.Arg(0)
+
+	buf, err := ioutil.ReadFile(file)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	fmt.Printf("Hello %s! This is the Malang programming language!\n", user.Username)
-	fmt.Printf("Feel free to type in commands\n")
+
+	var bytecode *compiler.Bytecode
+	if filepath.Ext(file) == ".malc" {
+		bytecode, err = compiler.Decode(bytes.NewReader(buf))
+	} else {
+		bytecode, err = repl.CompileFile(file, string(buf), module.SplitSearchPath(*path))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return 1
+	}
+
+	fmt.Print(compiler.Disassemble(bytecode))
+	return 0
+}
+
+// 根据执行结果得到进程退出码,出错时把错误输出到stderr
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exit, ok := err.(*object.Exit); ok {
+		return exit.Code
+	}
+
+	// 运行时错误附带调用栈
+	fmt.Fprintln(os.Stderr, err)
+	if rtErr, ok := err.(*vm.RuntimeError); ok {
+		fmt.Fprint(os.Stderr, rtErr.StackTrace())
+	}
+	return 1
+}
+
+func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			os.Exit(buildCmd(os.Args[2:]))
+		case "run":
+			os.Exit(runCmd(os.Args[2:]))
+		case "disasm":
+			os.Exit(disasmCmd(os.Args[2:]))
+		}
+	}
+
 	cmd := parseCmd()
+	repl.SetOptimize(!cmd.noOptimize)
 	if cmd.versionFlag {
 		fmt.Println("version: 0.0.1 by malred 2023.6.6")
 	} else if cmd.helpFlag {
 		printUsage()
 	} else if cmd.replFlag {
-		repl.StartVM(os.Stdin, os.Stdout)
-	} else {
-		// 读取-f指定的文件
-		fmt.Println("reading: ", cmd.cpOption)
-		buf, err := ioutil.ReadFile(cmd.cpOption)
+		// 只有交互模式才输出欢迎信息
+		user, err := user.Current()
 		if err != nil {
 			panic(err)
 		}
-		input := string(buf)
-		repl.ReadAndEval(input)
+		fmt.Printf("Hello %s! This is the Malang programming language!\n", user.Username)
+		fmt.Printf("Feel free to type in commands\n")
+		repl.StartVM(os.Stdin, os.Stdout)
+	} else {
+		os.Exit(runFile(cmd))
+	}
+}
+
+// 执行-f指定的文件,返回进程退出码
+func runFile(cmd *Cmd) int {
+	if cmd.cpOption == "" {
+		printUsage()
+		return 2
+	}
+
+	var run func(file string, input string, searchPath []string, args []string) error
+	switch cmd.engine {
+	case "vm":
+		run = repl.ReadAndRun
+	case "eval":
+		run = repl.ReadAndEval
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine %q (want vm or eval)\n", cmd.engine)
+		return 2
 	}
+
+	buf, err := ioutil.ReadFile(cmd.cpOption)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return exitCode(run(cmd.cpOption, string(buf), module.SplitSearchPath(cmd.pathOption), cmd.args))
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunFileExitCode(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected int
+	}{
+		{`puts("ok")`, 0},
+		{`exit(3)`, 3},
+		// 内置函数返回的错误中断执行,两个引擎的退出码相同
+		{`len(1, 2); puts("after")`, 1},
+		{`read_file("/nonexistent/x"); puts("after")`, 1},
+		{`1 +`, 1},
+		{`let x = x + 1; puts(x)`, 1},
+	}
+
+	for _, tt := range ts {
+		file := filepath.Join(t.TempDir(), "t.mal")
+		if err := ioutil.WriteFile(file, []byte(tt.input), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, engine := range []string{"vm", "eval"} {
+			code := runFile(&Cmd{cpOption: file, engine: engine})
+			if code != tt.expected {
+				t.Errorf("%s (engine=%s): wrong exit code. want=%d, got=%d", tt.input, engine, tt.expected, code)
+			}
+		}
+	}
+}
+
+// 命令行参数按每次执行传入,两个引擎的args()相同
+func TestRunFileArgs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "t.mal")
+	input := `exit(len(args()) * 10 + len(args()[1]))`
+	if err := ioutil.WriteFile(file, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, engine := range []string{"vm", "eval"} {
+		if code := runFile(&Cmd{cpOption: file, engine: engine, args: []string{"in.txt", "-v"}}); code != 22 {
+			t.Errorf("engine=%s: wrong exit code. want=22, got=%d", engine, code)
+		}
+		if code := runFile(&Cmd{cpOption: file, engine: engine, args: []string{"a", "b", "cde"}}); code != 31 {
+			t.Errorf("engine=%s: wrong exit code. want=31, got=%d", engine, code)
+		}
+	}
+}
+
+// 标准库编译在程序中,在任何目录下都可以执行文件
+func TestRunFileOutsideSourceDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "t.mal")
+	if err := ioutil.WriteFile(file, []byte(`map([1, 2], fn(x) { x * 2 })`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, engine := range []string{"vm", "eval"} {
+		if code := runFile(&Cmd{cpOption: file, engine: engine}); code != 0 {
+			t.Errorf("engine=%s: wrong exit code. want=0, got=%d", engine, code)
+		}
+	}
+}
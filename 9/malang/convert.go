@@ -0,0 +1,125 @@
+// malang/convert.go
+package malang
+
+import (
+	"fmt"
+	"malang/object"
+	"math"
+	"reflect"
+)
+
+// 把Go的值转换为malang对象
+// 支持nil、bool、整数、浮点数、string、切片/数组、键为string/整数/bool的map、
+// object.Object(原样返回)和object.BuiltinFunction
+func ToObject(v interface{}) (object.Object, error) {
+	switch v := v.(type) {
+	case nil:
+		return object.NULL, nil
+	case object.Object:
+		return v, nil
+	case object.BuiltinFunction:
+		return &object.Builtin{Fn: v}, nil
+	case func(args ...object.Object) object.Object:
+		return &object.Builtin{Fn: v}, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return object.TRUE, nil
+		}
+		return object.FALSE, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: rv.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("integer %d overflows INTEGER", rv.Uint())
+		}
+		return &object.Integer{Value: int64(rv.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: rv.Float()}, nil
+	case reflect.String:
+		return &object.String{Value: rv.String()}, nil
+	case reflect.Slice, reflect.Array:
+		elements := make([]object.Object, rv.Len())
+		for i := range elements {
+			elem, err := ToObject(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = elem
+		}
+		return &object.Array{Elements: elements}, nil
+	case reflect.Map:
+		pairs := make(map[object.HashKey]object.HashPair, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, err := ToObject(iter.Key().Interface())
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := key.(object.Hashable)
+			if !ok {
+				return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			}
+			value, err := ToObject(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			pairs[hashable.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %T to a malang value", v)
+	}
+}
+
+// 把malang对象转换为Go的值
+// INTEGER -> int64, FLOAT -> float64, STRING -> string, BOOLEAN -> bool, NULL -> nil,
+// ARRAY -> []interface{}, HASH -> 键都是字符串时为map[string]interface{},否则为map[interface{}]interface{}
+// 其他对象(函数、模块等)原样返回
+func FromObject(obj object.Object) interface{} {
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return nil
+	case *object.Integer:
+		return obj.Value
+	case *object.Float:
+		return obj.Value
+	case *object.String:
+		return obj.Value
+	case *object.Boolean:
+		return obj.Value
+	case *object.Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, elem := range obj.Elements {
+			elements[i] = FromObject(elem)
+		}
+		return elements
+	case *object.Hash:
+		if stringKeys(obj) {
+			m := make(map[string]interface{}, len(obj.Pairs))
+			for _, pair := range obj.Pairs {
+				m[pair.Key.(*object.String).Value] = FromObject(pair.Value)
+			}
+			return m
+		}
+		m := make(map[interface{}]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			m[FromObject(pair.Key)] = FromObject(pair.Value)
+		}
+		return m
+	default:
+		return obj
+	}
+}
+
+func stringKeys(hash *object.Hash) bool {
+	for _, pair := range hash.Pairs {
+		if _, ok := pair.Key.(*object.String); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+// malang/runtime.go
+// 在Go程序中嵌入malang:
+//
+//	rt, err := malang.New()
+//	rt.SetGlobal("limit", 10)
+//	rt.Eval(`let double = fn(x) { x * limit }`)
+//	result, err := rt.Call("double", 2)
+//	fmt.Println(malang.FromObject(result)) // 20
+package malang
+
+import (
+	"context"
+	"fmt"
+	"malang/code"
+	"malang/compiler"
+	"malang/lexer"
+	"malang/module"
+	"malang/object"
+	"malang/parser"
+	"malang/std"
+	"malang/vm"
+	"strings"
+)
+
+// 字节码虚拟机的执行环境,多次Eval之间共享全局变量、常量池和内置函数
+// Runtime不是并发安全的
+type Runtime struct {
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     *vm.Globals
+	verifier    *compiler.Verifier // 只校验新增的常量
+
+	registry *object.Registry
+	modules  *module.Loader
+	limits   vm.Limits // 每次Eval和Call单独计算
+}
+
+// 创建执行环境并加载标准库
+func New() (*Runtime, error) {
+	r := &Runtime{
+		symbolTable: compiler.NewSymbolTable(),
+		constants:   []object.Object{},
+		globals:     vm.NewGlobals(),
+		verifier:    compiler.NewVerifier(),
+		registry:    object.NewRegistry(),
+		modules:     module.NewLoader(nil),
+	}
+	r.symbolTable.DefineBuiltins(r.registry)
+
+	_, err := r.EvalFile("std/std.mal", std.Source)
+	if err != nil {
+		return nil, fmt.Errorf("loading std: %s", err)
+	}
+	return r, nil
+}
+
+// 设置执行限制,用于运行不受信任的脚本
+func (r *Runtime) SetLimits(l vm.Limits) {
+	r.limits = l
+}
+
+// 只授权allowed中的权限,没有授权的内置函数在之后执行的代码中不可用
+// 已经定义的函数(包括标准库)使用它们时返回*object.PermissionError
+func (r *Runtime) Restrict(allowed ...object.Capability) {
+	r.registry = r.registry.Restrict(allowed...)
+	r.symbolTable.DefineBuiltins(r.registry)
+}
+
+// 设置use的模块搜索路径
+func (r *Runtime) SetSearchPath(searchPath []string) {
+	r.modules = module.NewLoader(searchPath)
+}
+
+// 设置args()返回的命令行参数,只影响这个Runtime
+func (r *Runtime) SetArgs(args []string) {
+	r.registry.SetArgs(args)
+}
+
+// 注册宿主程序提供的内置函数,之后执行的代码可以直接调用
+func (r *Runtime) Register(name string, fn object.BuiltinFunction) error {
+	err := r.registry.Register(name, fn)
+	if err != nil {
+		return err
+	}
+
+	r.symbolTable.DefineBuiltins(r.registry)
+	return nil
+}
+
+// 执行一段源码,返回最后一个表达式语句的值
+func (r *Runtime) Eval(source string) (object.Object, error) {
+	return r.EvalContext(context.Background(), "", source)
+}
+
+// 执行一段源码,file用于错误信息中的位置和解析相对路径的use
+func (r *Runtime) EvalFile(file string, source string) (object.Object, error) {
+	return r.EvalContext(context.Background(), file, source)
+}
+
+// 同EvalFile,ctx取消或超时时停止执行
+func (r *Runtime) EvalContext(ctx context.Context, file string, source string) (object.Object, error) {
+	p := parser.New(lexer.NewWithFile(file, source))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, fmt.Errorf("parse errors:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+
+	// 编译失败时撤销已经定义的全局变量,它们在全局槽位中没有值
+	state := r.symbolTable.Save()
+	comp := compiler.NewWithState(r.symbolTable, r.constants)
+	comp.SetModuleLoader(r.modules)
+	err := comp.Compile(program)
+	if err != nil {
+		r.symbolTable.Restore(state)
+		return nil, err
+	}
+
+	bytecode := comp.Bytecode()
+	r.constants = bytecode.Constants
+
+	machine := r.newVM(bytecode)
+	err = machine.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if machine.LastPoppedStackElem() == nil {
+		return vm.Null, nil
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// 调用全局函数,参数会用ToObject转换
+func (r *Runtime) Call(fnName string, args ...interface{}) (object.Object, error) {
+	return r.CallContext(context.Background(), fnName, args...)
+}
+
+// 同Call,ctx取消或超时时停止执行
+func (r *Runtime) CallContext(ctx context.Context, fnName string, args ...interface{}) (object.Object, error) {
+	fn, ok := r.GetGlobal(fnName)
+	if !ok {
+		return nil, fmt.Errorf("undefined function %s", fnName)
+	}
+	switch fn.(type) {
+	case *object.Closure, *object.Builtin:
+	default:
+		return nil, fmt.Errorf("%s is not a function: %s", fnName, fn.Type())
+	}
+
+	// 函数和参数追加到常量池末尾,这样函数体内的常量下标仍然有效
+	constants := append(r.constants[:len(r.constants):len(r.constants)], fn)
+	instructions := code.Make(code.OpConstant, len(constants)-1)
+	for i, arg := range args {
+		obj, err := ToObject(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i, err)
+		}
+		constants = append(constants, obj)
+		instructions = append(instructions, code.Make(code.OpConstant, len(constants)-1)...)
+	}
+	if len(constants) > 1<<16 {
+		return nil, fmt.Errorf("too many constants")
+	}
+	instructions = append(instructions, code.Make(code.OpCall, len(args))...)
+	instructions = append(instructions, code.Make(code.OpPop)...)
+
+	machine := r.newVM(&compiler.Bytecode{
+		Instructions: instructions,
+		Constants:    constants,
+		NumGlobals:   r.symbolTable.NumGlobals(),
+	})
+	err := machine.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// 设置全局变量,不存在时定义,value会用ToObject转换
+func (r *Runtime) SetGlobal(name string, value interface{}) error {
+	obj, err := ToObject(value)
+	if err != nil {
+		return err
+	}
+
+	symbol, ok := r.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		symbol = r.symbolTable.Define(name)
+	}
+	r.globals.Set(symbol.Index, obj)
+	return nil
+}
+
+// 获取全局变量,内置函数也可以获取
+func (r *Runtime) GetGlobal(name string) (object.Object, bool) {
+	symbol, ok := r.symbolTable.Resolve(name)
+	if !ok {
+		return nil, false
+	}
+
+	switch symbol.Scope {
+	case compiler.GlobalScope:
+		obj := r.globals.Get(symbol.Index)
+		if obj == nil {
+			return nil, false
+		}
+		return obj, true
+	case compiler.BuiltinScope:
+		return r.registry.Get(symbol.Index), true
+	default:
+		return nil, false
+	}
+}
+
+func (r *Runtime) newVM(bytecode *compiler.Bytecode) *vm.VM {
+	machine := vm.NewWithState(bytecode, r.globals)
+	machine.SetRegistry(r.registry)
+	machine.SetVerifier(r.verifier)
+	machine.SetLimits(r.limits)
+	return machine
+}
@@ -0,0 +1,387 @@
+package malang
+
+import (
+	"context"
+	"errors"
+	"malang/module/moduletest"
+	"malang/object"
+	"malang/vm"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newRuntime(t *testing.T) *Runtime {
+	t.Helper()
+	rt, err := New()
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+	return rt
+}
+
+func TestRuntimeEval(t *testing.T) {
+	rt := newRuntime(t)
+
+	ts := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`1 + 2`, int64(3)},
+		{`let x = 10;`, int64(10)},
+		{`x * 2`, int64(20)},
+		{`let add = fn(a, b) { a + b }; add(x, 1)`, int64(11)},
+		// 标准库已经加载
+		{`sum(map([1, 2, 3], fn(n) { n * x }))`, int64(60)},
+		{`{"name": "malang", "tags": ["a", "b"]}`, map[string]interface{}{"name": "malang", "tags": []interface{}{"a", "b"}}},
+		{`{1: true}`, map[interface{}]interface{}{int64(1): true}},
+		{`if (false) { 1 }`, nil},
+	}
+
+	for _, tt := range ts {
+		result, err := rt.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("%s: eval error: %s", tt.input, err)
+		}
+		if got := FromObject(result); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: want=%#v, got=%#v", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	rt := newRuntime(t)
+
+	ts := []struct {
+		input       string
+		expectedErr string
+	}{
+		{`let = 1`, "parse errors:\n\t1:5: expected next token to be IDENT, got = instead\n\t1:5: no prefix parse function for = found"},
+		{`undefined_name`, "1:1: undefined variable undefined_name"},
+		{`1 / 0`, "1:1: division by zero"},
+		// 编译失败时不会留下没有值的全局变量
+		{`let x = 1; y`, "1:12: undefined variable y"},
+		{`x + 1`, "1:1: undefined variable x"},
+	}
+
+	for _, tt := range ts {
+		_, err := rt.Eval(tt.input)
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("%s: want error %q, got %v", tt.input, tt.expectedErr, err)
+		}
+	}
+
+	// 出错之后仍然可以继续使用
+	result, err := rt.Eval(`1 + 1`)
+	if err != nil || FromObject(result) != int64(2) {
+		t.Errorf("eval after error: got %v, %v", result, err)
+	}
+
+	_, err = rt.Eval(`exit(3)`)
+	if exit, ok := err.(*object.Exit); !ok || exit.Code != 3 {
+		t.Errorf("want *object.Exit with code 3, got %T (%v)", err, err)
+	}
+}
+
+func TestRuntimeCall(t *testing.T) {
+	rt := newRuntime(t)
+	_, err := rt.Eval(`
+let greet = fn(name, times) {
+	let s = "";
+	let i = 0;
+	for (i < times) { s += "hi " + name + "!"; i += 1 };
+	s
+};
+let total = fn(values) { sum(values) + 0.5 };
+let notfn = 1;
+`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	ts := []struct {
+		fn       string
+		args     []interface{}
+		expected interface{}
+	}{
+		{"greet", []interface{}{"go", 2}, "hi go!hi go!"},
+		{"total", []interface{}{[]int{1, 2, 3}}, 6.5},
+		{"len", []interface{}{"four"}, int64(4)},
+	}
+	for _, tt := range ts {
+		result, err := rt.Call(tt.fn, tt.args...)
+		if err != nil {
+			t.Fatalf("%s: call error: %s", tt.fn, err)
+		}
+		if got := FromObject(result); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: want=%#v, got=%#v", tt.fn, tt.expected, got)
+		}
+	}
+
+	errs := []struct {
+		fn          string
+		args        []interface{}
+		expectedErr string
+	}{
+		{"missing", nil, "undefined function missing"},
+		{"notfn", nil, "notfn is not a function: INTEGER"},
+		{"greet", []interface{}{"go"}, "wrong number of arguments: want=2, got=1"},
+		{"greet", []interface{}{struct{}{}, 1}, "argument 0: cannot convert struct {} to a malang value"},
+	}
+	for _, tt := range errs {
+		_, err := rt.Call(tt.fn, tt.args...)
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("%s: want error %q, got %v", tt.fn, tt.expectedErr, err)
+		}
+	}
+}
+
+func TestRuntimeGlobals(t *testing.T) {
+	rt := newRuntime(t)
+
+	if err := rt.SetGlobal("config", map[string]interface{}{"limit": 3, "debug": true}); err != nil {
+		t.Fatalf("SetGlobal error: %s", err)
+	}
+	result, err := rt.Eval(`let limit = config["limit"] * 2; config["debug"]`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if FromObject(result) != true {
+		t.Errorf("want true, got %s", result.Inspect())
+	}
+
+	limit, ok := rt.GetGlobal("limit")
+	if !ok || FromObject(limit) != int64(6) {
+		t.Errorf("GetGlobal(limit): want 6, got %v (ok=%t)", limit, ok)
+	}
+
+	// 覆盖已有的全局变量
+	if err := rt.SetGlobal("limit", 1.5); err != nil {
+		t.Fatalf("SetGlobal error: %s", err)
+	}
+	result, err = rt.Eval(`limit * 2`)
+	if err != nil || FromObject(result) != 3.0 {
+		t.Errorf("want 3.0, got %v, %v", result, err)
+	}
+
+	if _, ok := rt.GetGlobal("nothing"); ok {
+		t.Errorf("GetGlobal(nothing) should not be found")
+	}
+	if err := rt.SetGlobal("bad", make(chan int)); err == nil {
+		t.Errorf("SetGlobal with a channel should fail")
+	}
+}
+
+func TestRuntimeRegister(t *testing.T) {
+	rt := newRuntime(t)
+
+	var logged []string
+	err := rt.Register("log", func(args ...object.Object) object.Object {
+		for _, arg := range args {
+			logged = append(logged, arg.Inspect())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register error: %s", err)
+	}
+
+	_, err = rt.Eval(`let f = fn(x) { log("x", x) }; f(1); f(2)`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if expected := []string{"x", "1", "x", "2"}; !reflect.DeepEqual(logged, expected) {
+		t.Errorf("want logged=%v, got %v", expected, logged)
+	}
+
+	if err := rt.Register("let", nil); err == nil {
+		t.Errorf("registering a keyword should fail")
+	}
+}
+
+func TestRuntimeArgs(t *testing.T) {
+	rt := newRuntime(t)
+	rt.SetArgs([]string{"a", "b"})
+	other := newRuntime(t)
+
+	ts := []struct {
+		rt       *Runtime
+		expected int64
+	}{
+		{rt, 2},
+		{other, 0},
+	}
+	for _, tt := range ts {
+		result, err := tt.rt.Eval(`len(args())`)
+		if err != nil {
+			t.Fatalf("eval error: %s", err)
+		}
+		if n, ok := result.(*object.Integer); !ok || n.Value != tt.expected {
+			t.Errorf("wrong len(args()). want=%d, got=%v", tt.expected, result)
+		}
+	}
+}
+
+// 多次Eval使用同一个模块时,模块只编译和初始化一次
+func TestRuntimeUseAcrossEvals(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"cnt.mal": "let count = 0;\nexport let inc = fn() { count += 1 };\ninc();",
+	})
+
+	rt := newRuntime(t)
+	rt.SetSearchPath([]string{dir})
+
+	inputs := []struct {
+		input    string
+		expected int64
+	}{
+		{"use cnt; cnt.inc()", 2},
+		{"use cnt; cnt.inc()", 3},
+		{"use cnt as c; let f = fn() { use cnt; cnt.inc() }; f()", 4},
+	}
+	for _, tt := range inputs {
+		result, err := rt.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error: %s", err)
+		}
+		if FromObject(result) != tt.expected {
+			t.Errorf("%s: want %d, got %v", tt.input, tt.expected, result)
+		}
+	}
+
+	// 编译失败时编译的模块不会留在缓存中
+	rt = newRuntime(t)
+	rt.SetSearchPath([]string{dir})
+	if _, err := rt.Eval("use cnt; undefined_name"); err == nil {
+		t.Fatalf("expected compile error")
+	}
+	result, err := rt.Eval("use cnt; cnt.inc()")
+	if err != nil || FromObject(result) != int64(2) {
+		t.Errorf("use after compile error: got %v, %v", result, err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ts := []struct {
+		input    interface{}
+		expected string // Inspect()的结果
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-3), "-3"},
+		{uint32(7), "7"},
+		{float32(0.5), "0.5"},
+		{"s", "s"},
+		{[]string{"a", "b"}, "[a, b]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{map[int]string{1: "one"}, "{1: one}"},
+		{&object.Integer{Value: 9}, "9"},
+	}
+
+	for _, tt := range ts {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Fatalf("ToObject(%v) error: %s", tt.input, err)
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("ToObject(%#v): want=%q, got=%q", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+
+	errs := []struct {
+		input       interface{}
+		expectedErr string
+	}{
+		{uint64(1 << 63), "integer 9223372036854775808 overflows INTEGER"},
+		{map[[1]int]int{{1}: 1}, "unusable as hash key: ARRAY"},
+		{[]interface{}{1, struct{}{}}, "cannot convert struct {} to a malang value"},
+	}
+	for _, tt := range errs {
+		_, err := ToObject(tt.input)
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("ToObject(%#v): want error %q, got %v", tt.input, tt.expectedErr, err)
+		}
+	}
+}
+
+func TestRuntimeLimits(t *testing.T) {
+	rt := newRuntime(t)
+	rt.SetLimits(vm.Limits{MaxInstructions: 10000})
+
+	_, err := rt.Eval(`let spin = fn() { for (true) { } }; spin()`)
+	if !errors.Is(err, vm.ErrInstructionLimit) {
+		t.Errorf("want ErrInstructionLimit, got %v", err)
+	}
+	_, err = rt.Call("spin")
+	if !errors.Is(err, vm.ErrInstructionLimit) {
+		t.Errorf("want ErrInstructionLimit from Call, got %v", err)
+	}
+
+	// 每次执行单独计算
+	result, err := rt.Eval(`sum([1, 2, 3])`)
+	if err != nil || FromObject(result) != int64(6) {
+		t.Errorf("want 6, got %v, %v", result, err)
+	}
+
+	rt.SetLimits(vm.Limits{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = rt.CallContext(ctx, "spin")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRuntimeRestrict(t *testing.T) {
+	rt := newRuntime(t)
+	rt.Register("log", func(args ...object.Object) object.Object { return nil })
+	rt.Restrict(object.CapEnv)
+
+	result, err := rt.Eval(`log(1); sum([1, 2])`)
+	if err != nil || FromObject(result) != int64(3) {
+		t.Errorf("want 3, got %v, %v", result, err)
+	}
+
+	_, err = rt.Eval(`read_file("/etc/passwd")`)
+	if err == nil || err.Error() != "1:1: undefined variable read_file" {
+		t.Errorf("want undefined variable error, got %v", err)
+	}
+
+	// 之前定义的函数使用时报错
+	rt = newRuntime(t)
+	if _, err := rt.Eval(`let quit = fn() { exit(1) }`); err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	rt.Restrict()
+	_, err = rt.Call("quit")
+	var permErr *object.PermissionError
+	if !errors.As(err, &permErr) || permErr.Builtin != "exit" {
+		t.Errorf("want permission error for exit, got %v", err)
+	}
+
+	// 限制之前保存在变量和数据结构中的内置函数,调用时同样报错
+	rt = newRuntime(t)
+	if _, err := rt.Eval(`let p = puts; let fs = [read_file]; let h = {"f": getenv}`); err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	rt.Restrict(object.CapEnv)
+	inputs := []struct {
+		input   string
+		builtin string
+	}{
+		{`p("x")`, "puts"},
+		{`fs[0]("/etc/passwd")`, "read_file"},
+	}
+	for _, tt := range inputs {
+		_, err = rt.Eval(tt.input)
+		if !errors.As(err, &permErr) || permErr.Builtin != tt.builtin {
+			t.Errorf("%s: want permission error for %s, got %v", tt.input, tt.builtin, err)
+		}
+	}
+	if _, err := rt.Eval(`h["f"]("HOME")`); err != nil {
+		t.Errorf("getenv should be allowed with CapEnv: %s", err)
+	}
+	if _, err := rt.Call("p", "x"); !errors.As(err, &permErr) || permErr.Builtin != "puts" {
+		t.Errorf("want permission error for puts, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+// module/module.go
+package module
+
+import (
+	"fmt"
+	"io/ioutil"
+	"malang/ast"
+	"malang/lexer"
+	"malang/parser"
+	"malang/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 模块加载器,负责解析use的路径、解析源码并检测循环导入
+type Loader struct {
+	// 搜索路径,在导入方文件所在目录找不到时依次查找
+	SearchPath []string
+
+	// 正在加载的模块,用于检测循环导入
+	loading []string
+	// 已解析的模块
+	programs map[string]*ast.Program
+}
+
+func NewLoader(searchPath []string) *Loader {
+	return &Loader{
+		SearchPath: searchPath,
+		programs:   make(map[string]*ast.Program),
+	}
+}
+
+// 按系统路径分隔符拆分搜索路径,忽略空项
+func SplitSearchPath(s string) []string {
+	var paths []string
+	for _, p := range filepath.SplitList(s) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// 解析模块路径:先查找导入方文件所在目录(没有文件时为当前目录),再依次查找搜索路径
+func (l *Loader) Resolve(name string, from token.Position) (string, error) {
+	if filepath.IsAbs(name) {
+		if fileExists(name) {
+			return filepath.Clean(name), nil
+		}
+		return "", fmt.Errorf("module not found: %s", name)
+	}
+
+	dirs := []string{"."}
+	if from.File != "" {
+		dirs[0] = filepath.Dir(from.File)
+	}
+	dirs = append(dirs, l.SearchPath...)
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if fileExists(path) {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return "", err
+			}
+			return abs, nil
+		}
+	}
+
+	return "", fmt.Errorf("module not found: %s (searched: %s)", name, strings.Join(dirs, ", "))
+}
+
+// 读取并解析模块,结果会被缓存
+func (l *Loader) Parse(path string) (*ast.Program, error) {
+	if program, ok := l.programs[path]; ok {
+		return program, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.NewWithFile(path, string(buf)))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, fmt.Errorf("parse errors in module %s:\n\t%s", path, strings.Join(errs, "\n\t"))
+	}
+
+	l.programs[path] = program
+	return program, nil
+}
+
+// 开始加载模块,模块已在加载链上时返回循环导入错误
+func (l *Loader) Enter(path string) error {
+	for i, p := range l.loading {
+		if p == path {
+			chain := append(append([]string{}, l.loading[i:]...), path)
+			return fmt.Errorf("import cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	l.loading = append(l.loading, path)
+	return nil
+}
+
+// 模块加载结束
+func (l *Loader) Leave() {
+	l.loading = l.loading[:len(l.loading)-1]
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// 模块名,即去掉扩展名的文件名
+func Name(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// 模块顶层export let导出的名字,按字母排序
+func Exports(program *ast.Program) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, s := range program.Statements {
+		if let, ok := s.(*ast.LetStatement); ok && let.Exported && !seen[let.Name.Value] {
+			seen[let.Name.Value] = true
+			names = append(names, let.Name.Value)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
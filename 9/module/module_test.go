@@ -0,0 +1,115 @@
+package module
+
+import (
+	"malang/module/moduletest"
+	"malang/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 在临时目录中写入模块文件,返回目录路径
+func TestResolve(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"main.mal":     "",
+		"a.mal":        "",
+		"lib/a.mal":    "",
+		"lib/b.mal":    "",
+		"vendor/c.mal": "",
+	})
+	from := token.Position{File: filepath.Join(dir, "main.mal"), Line: 1, Column: 1}
+	loader := NewLoader([]string{filepath.Join(dir, "lib"), filepath.Join(dir, "vendor")})
+
+	ts := []struct {
+		name     string
+		expected string
+	}{
+		// 导入方所在目录优先于搜索路径
+		{"a.mal", filepath.Join(dir, "a.mal")},
+		{"b.mal", filepath.Join(dir, "lib", "b.mal")},
+		{"c.mal", filepath.Join(dir, "vendor", "c.mal")},
+	}
+
+	for _, tt := range ts {
+		path, err := loader.Resolve(tt.name, from)
+		if err != nil {
+			t.Fatalf("resolve %q: %s", tt.name, err)
+		}
+		if path != tt.expected {
+			t.Errorf("resolve %q: want=%q, got=%q", tt.name, tt.expected, path)
+		}
+	}
+
+	// 从lib中的模块导入时,先查找lib目录
+	from = token.Position{File: filepath.Join(dir, "lib", "b.mal"), Line: 1, Column: 1}
+	path, err := loader.Resolve("a.mal", from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "lib", "a.mal") {
+		t.Errorf("wrong path. got=%q", path)
+	}
+
+	_, err = loader.Resolve("nope.mal", from)
+	if err == nil || !strings.HasPrefix(err.Error(), "module not found: nope.mal") {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"ok.mal":  "let x = 1;",
+		"bad.mal": "let = 1;",
+	})
+	loader := NewLoader(nil)
+
+	program, err := loader.Parse(filepath.Join(dir, "ok.mal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := loader.Parse(filepath.Join(dir, "ok.mal"))
+	if program != again {
+		t.Errorf("module was parsed twice")
+	}
+
+	_, err = loader.Parse(filepath.Join(dir, "bad.mal"))
+	if err == nil || !strings.Contains(err.Error(), "bad.mal:1:5") {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	loader := NewLoader(nil)
+
+	for _, path := range []string{"a.mal", "b.mal", "c.mal"} {
+		if err := loader.Enter(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := loader.Enter("b.mal")
+	if err == nil {
+		t.Fatalf("expected import cycle error")
+	}
+	if err.Error() != "import cycle: b.mal -> c.mal -> b.mal" {
+		t.Errorf("wrong error. got=%q", err)
+	}
+
+	loader.Leave()
+	loader.Leave()
+	if err := loader.Enter("c.mal"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestSplitSearchPath(t *testing.T) {
+	s := strings.Join([]string{"lib", "", "vendor"}, string(os.PathListSeparator))
+	paths := SplitSearchPath(s)
+	if len(paths) != 2 || paths[0] != "lib" || paths[1] != "vendor" {
+		t.Errorf("wrong search path. got=%q", paths)
+	}
+	if len(SplitSearchPath("")) != 0 {
+		t.Errorf("expected empty search path")
+	}
+}
@@ -2,6 +2,10 @@ package object
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	// "log"
 )
 
@@ -31,6 +35,7 @@ var Builtins = []struct {
 	{
 		"puts",
 		&Builtin{
+			Capability: CapIO,
 			Fn: func(args ...Object) Object {
 				for _, arg := range args {
 					fmt.Println(arg.Inspect())
@@ -147,6 +152,269 @@ var Builtins = []struct {
 			},
 		},
 	},
+	{
+		"int",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *Integer:
+					return arg
+				case *Float:
+					// 向零取整
+					return &Integer{Value: int64(arg.Value)}
+				case *String:
+					value, err := strconv.ParseInt(strings.TrimSpace(arg.Value), 0, 64)
+					if err != nil {
+						return newError("could not convert %q to INTEGER", arg.Value)
+					}
+					return &Integer{Value: value}
+				default:
+					return newError("argument to `int` not supported, got %s", args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		"float",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *Integer:
+					return &Float{Value: float64(arg.Value)}
+				case *Float:
+					return arg
+				case *String:
+					value, err := strconv.ParseFloat(strings.TrimSpace(arg.Value), 64)
+					if err != nil {
+						return newError("could not convert %q to FLOAT", arg.Value)
+					}
+					return &Float{Value: value}
+				default:
+					return newError("argument to `float` not supported, got %s", args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		"args",
+		argsBuiltin(nil),
+	},
+	{
+		"getenv",
+		&Builtin{
+			Capability: CapEnv,
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				name, ok := args[0].(*String)
+				if !ok {
+					return newError("argument to `getenv` must be STRING. got %s", args[0].Type())
+				}
+
+				// 未设置的环境变量返回null
+				if value, ok := os.LookupEnv(name.Value); ok {
+					return &String{Value: value}
+				}
+				return nil
+			},
+		},
+	},
+	{
+		"exit",
+		&Builtin{
+			Capability: CapProcess,
+			Fn: func(args ...Object) Object {
+				if len(args) > 1 {
+					return newError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+				}
+				if len(args) == 0 {
+					return &Exit{Code: 0}
+				}
+
+				code, ok := args[0].(*Integer)
+				if !ok {
+					return newError("argument to `exit` must be INTEGER. got %s", args[0].Type())
+				}
+				if code.Value < 0 || code.Value > 255 {
+					return newError("exit code out of range: %d", code.Value)
+				}
+				return &Exit{Code: int(code.Value)}
+			},
+		},
+	},
+	// 文件读写,失败时返回错误对象
+	{
+		"read_file",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				path, errObj := pathArgument("read_file", 1, args)
+				if errObj != nil {
+					return errObj
+				}
+
+				buf, err := ioutil.ReadFile(path)
+				if err != nil {
+					return newError("read_file: %s", err)
+				}
+				return &String{Value: string(buf)}
+			},
+		},
+	},
+	{
+		"write_file",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				return writeFile("write_file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, args)
+			},
+		},
+	},
+	{
+		"append_file",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				return writeFile("append_file", os.O_WRONLY|os.O_CREATE|os.O_APPEND, args)
+			},
+		},
+	},
+	{
+		"read_lines",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				path, errObj := pathArgument("read_lines", 1, args)
+				if errObj != nil {
+					return errObj
+				}
+
+				buf, err := ioutil.ReadFile(path)
+				if err != nil {
+					return newError("read_lines: %s", err)
+				}
+
+				// 末尾的换行不产生空行,兼容\r\n
+				content := strings.TrimSuffix(string(buf), "\n")
+				elements := []Object{}
+				if content != "" {
+					for _, line := range strings.Split(content, "\n") {
+						elements = append(elements, &String{Value: strings.TrimSuffix(line, "\r")})
+					}
+				}
+				return &Array{Elements: elements}
+			},
+		},
+	},
+	{
+		"exists",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				path, errObj := pathArgument("exists", 1, args)
+				if errObj != nil {
+					return errObj
+				}
+
+				_, err := os.Stat(path)
+				if err == nil {
+					return TRUE
+				}
+				if os.IsNotExist(err) {
+					return FALSE
+				}
+				return newError("exists: %s", err)
+			},
+		},
+	},
+	{
+		"list_dir",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				path, errObj := pathArgument("list_dir", 1, args)
+				if errObj != nil {
+					return errObj
+				}
+
+				// 按文件名排序
+				entries, err := os.ReadDir(path)
+				if err != nil {
+					return newError("list_dir: %s", err)
+				}
+				elements := make([]Object, len(entries))
+				for i, entry := range entries {
+					elements[i] = &String{Value: entry.Name()}
+				}
+				return &Array{Elements: elements}
+			},
+		},
+	},
+	{
+		"remove",
+		&Builtin{
+			Capability: CapIO,
+			Fn: func(args ...Object) Object {
+				path, errObj := pathArgument("remove", 1, args)
+				if errObj != nil {
+					return errObj
+				}
+
+				// 只删除文件或空目录
+				err := os.Remove(path)
+				if err != nil {
+					return newError("remove: %s", err)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// 检查参数个数,并取出第一个参数作为路径
+func pathArgument(name string, want int, args []Object) (string, *Error) {
+	if len(args) != want {
+		return "", newError("wrong number of arguments. got=%d, want=%d", len(args), want)
+	}
+	path, ok := args[0].(*String)
+	if !ok {
+		return "", newError("first argument to `%s` must be STRING. got %s", name, args[0].Type())
+	}
+	return path.Value, nil
+}
+
+// write_file和append_file,成功时返回null
+func writeFile(name string, flag int, args []Object) Object {
+	path, errObj := pathArgument(name, 2, args)
+	if errObj != nil {
+		return errObj
+	}
+	content, ok := args[1].(*String)
+	if !ok {
+		return newError("second argument to `%s` must be STRING. got %s", name, args[1].Type())
+	}
+
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return newError("%s: %s", name, err)
+	}
+	_, err = f.WriteString(content.Value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return newError("%s: %s", name, err)
+	}
+	return nil
 }
 
 func newError(format string, a ...interface{}) *Error {
@@ -162,3 +430,22 @@ func GetBuiltinByName(name string) *Builtin {
 	}
 	return nil
 }
+
+// args()内置函数,返回脚本的命令行参数(不包括脚本名)
+// 参数随注册表保存,见Registry.SetArgs
+func argsBuiltin(scriptArgs []string) *Builtin {
+	return &Builtin{
+		Capability: CapProcess,
+		Fn: func(args ...Object) Object {
+			if len(args) != 0 {
+				return newError("wrong number of arguments. got=%d, want=0", len(args))
+			}
+
+			elements := make([]Object, len(scriptArgs))
+			for i, arg := range scriptArgs {
+				elements[i] = &String{Value: arg}
+			}
+			return &Array{Elements: elements}
+		},
+	}
+}
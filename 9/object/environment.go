@@ -1,10 +1,26 @@
 // object/environment.go
 package object
 
+import "malang/module"
+
 type Environment struct {
 	store map[string]Object
 	// 外层包裹自己的环境
 	outer *Environment
+	// use使用的模块状态,为nil时使用外层环境的
+	modules *Modules
+	// 内置函数注册表,为nil时使用外层环境的,都没有时使用标准内置函数
+	registry *Registry
+}
+
+// use使用的模块加载器和已执行过的模块,同一次执行中的所有环境共享
+type Modules struct {
+	Loader *module.Loader
+	Loaded map[string]*Module // 模块路径 -> 模块对象
+}
+
+func NewModules(l *module.Loader) *Modules {
+	return &Modules{Loader: l, Loaded: make(map[string]*Module)}
 }
 
 func NewEnvironment() *Environment {
@@ -12,6 +28,14 @@ func NewEnvironment() *Environment {
 	return &Environment{store: s, outer: nil}
 }
 
+// 创建模块的顶层环境,与env共享模块状态但不共享变量
+func NewModuleEnvironment(env *Environment) *Environment {
+	modEnv := NewEnvironment()
+	modEnv.modules = env.Modules()
+	modEnv.registry = env.Registry()
+	return modEnv
+}
+
 // 创建新环境,父级为outer
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
@@ -31,3 +55,55 @@ func (e *Environment) Set(name string, value Object) Object {
 	e.store[name] = value
 	return value
 }
+
+// 修改已声明的变量,沿外层环境查找,找不到时返回false
+func (e *Environment) Assign(name string, value Object) (Object, bool) {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = value
+		return value, true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, value)
+	}
+	return nil, false
+}
+
+// 最外层(全局)环境
+func (e *Environment) Root() *Environment {
+	for e.outer != nil {
+		e = e.outer
+	}
+	return e
+}
+
+// 设置use使用的模块加载器,同时清空已加载模块的记录
+func (e *Environment) SetModuleLoader(l *module.Loader) {
+	e.modules = NewModules(l)
+}
+
+// 环境使用的模块状态,沿外层环境查找,都没有时在最外层创建默认的
+func (e *Environment) Modules() *Modules {
+	for env := e; env != nil; env = env.outer {
+		if env.modules != nil {
+			return env.modules
+		}
+	}
+	root := e.Root()
+	root.modules = NewModules(module.NewLoader(nil))
+	return root.modules
+}
+
+// 设置求值时使用的内置函数注册表
+func (e *Environment) SetRegistry(r *Registry) {
+	e.registry = r
+}
+
+// 环境使用的内置函数注册表,沿外层环境查找,没有设置时返回nil
+func (e *Environment) Registry() *Registry {
+	for env := e; env != nil; env = env.outer {
+		if env.registry != nil {
+			return env.registry
+		}
+	}
+	return nil
+}
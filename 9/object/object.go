@@ -7,6 +7,9 @@ import (
 	"hash/fnv"
 	"malang/ast"
 	"malang/code"
+	"malang/token"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -15,20 +18,24 @@ type ObjectType string
 // 对象类型常量
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
 	CONTINUE              = "CONTINUE"
 	BREAK                 = "BREAK"
 	ERROR_OBJ             = "ERROR"
+	EXIT_OBJ              = "EXIT"
 	FUNCTION_OBJ          = "FUNCTION"
 	STRING_OBJ            = "STRING"
 	BUILTIN_OBJ           = "BUILTIN"
 	ARRAY_OBJ             = "ARRAY"
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
-	COMPILED_FOR_OBJ      = "COMPILED_FOR_OBJ"
 	CLOSURE_OBJ           = "CLOSURE_OBJ"
+	CELL_OBJ              = "CELL"
+	MODULE_OBJ            = "MODULE"
+	COMPILED_MODULE_OBJ   = "COMPILED_MODULE"
 )
 
 type Object interface {
@@ -43,6 +50,20 @@ type Integer struct {
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 
+type Float struct {
+	Value float64
+}
+
+// 最短的能还原该值的表示,整数值补上.0以便与整数区分
+func (f *Float) Inspect() string {
+	str := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(str, ".eIN") {
+		str += ".0"
+	}
+	return str
+}
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
 type Boolean struct {
 	Value bool
 }
@@ -55,6 +76,13 @@ type Null struct{}
 func (n *Null) Inspect() string  { return "null" }
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 
+// 唯一的布尔值和null,由两个执行引擎和内置函数共享,可以直接比较指针
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
 type ReturnValue struct {
 	Value Object
 }
@@ -64,10 +92,26 @@ func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
 type Error struct {
 	Message string
+	Pos     token.Position // 出错的源码位置
+	Thrown  Object         // throw抛出的值,运行时错误为nil
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
+func (e *Error) Inspect() string {
+	if e.Pos.IsValid() {
+		return "ERROR: " + e.Pos.String() + ": " + e.Message
+	}
+	return "ERROR: " + e.Message
+}
+
+// exit()的返回值,执行引擎遇到它时停止执行并向外传递退出码
+type Exit struct {
+	Code int
+}
+
+func (e *Exit) Type() ObjectType { return EXIT_OBJ }
+func (e *Exit) Inspect() string  { return fmt.Sprintf("exit(%d)", e.Code) }
+func (e *Exit) Error() string    { return fmt.Sprintf("exit status %d", e.Code) }
 
 type Function struct {
 	Parameters []*ast.Identifier
@@ -105,7 +149,8 @@ func (s *String) Inspect() string {
 
 type BuiltinFunction func(args ...Object) Object
 type Builtin struct {
-	Fn BuiltinFunction
+	Fn         BuiltinFunction
+	Capability Capability // 调用需要的权限,为空表示没有副作用,总是允许
 }
 
 func (b *Builtin) Type() ObjectType { return BOOLEAN_OBJ }
@@ -155,6 +200,14 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+// 整数值的浮点数与相等的整数使用同一个键,保证 h[1] 和 h[1.0] 取到同一项
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && f.Value >= math.MinInt64 && f.Value < math.MaxInt64 {
+		return (&Integer{Value: int64(f.Value)}).HashKey()
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
+
 func (s *String) HashKey() HashKey {
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
@@ -177,7 +230,7 @@ func (h *Hash) Inspect() string {
 
 	pairs := []string{}
 	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprint("%s: %s", pair.Key, pair.Value.Inspect()))
+		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
 	}
 
 	out.WriteString("{")
@@ -203,6 +256,8 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string         // 函数名(let绑定的名称),匿名函数为空
+	SourceMap     code.SourceMap // 指令偏移量到源码位置的映射
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -210,19 +265,58 @@ func (cf *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 
-type CompiledFor struct {
-	Instructions code.Instructions
-}
-
-func (cf *CompiledFor) Type() ObjectType { return COMPILED_FOR_OBJ }
-func (cf *CompiledFor) Inspect() string {
-	return fmt.Sprintf("CompiledFor[%p]", cf)
-}
-
 type Closure struct {
 	Fn   *CompiledFunction
-	Free []Object
+	Free []*Cell
 }
 
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
 func (c *Closure) Inspect() string  { return fmt.Sprintf("Closure[%p]", c) }
+
+// 被闭包捕获的变量装箱后存放在Cell中,
+// 外层函数和闭包共享同一个Cell,赋值对双方都可见
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string {
+	if c.Value == nil {
+		return "Cell[nil]"
+	}
+	return fmt.Sprintf("Cell[%s]", c.Value.Inspect())
+}
+
+// use导入的模块,只能访问导出的绑定。
+// Lookup读取绑定的当前值,模块内部修改导出的变量后外部可见
+type Module struct {
+	Name    string
+	Exports []string // 导出的名字,按字母排序
+	Lookup  func(name string) (Object, bool)
+}
+
+func (m *Module) Type() ObjectType { return MODULE_OBJ }
+func (m *Module) Inspect() string {
+	return fmt.Sprintf("module %s {%s}", m.Name, strings.Join(m.Exports, ", "))
+}
+
+// 读取导出的成员
+func (m *Module) Member(name string) (Object, error) {
+	if val, ok := m.Lookup(name); ok {
+		return val, nil
+	}
+	return nil, fmt.Errorf("module %s has no exported member %s", m.Name, name)
+}
+
+// 编译后的模块,作为常量保存在常量池中
+type CompiledModule struct {
+	Name    string
+	Init    *CompiledFunction // 模块顶层代码
+	Exports map[string]int    // 导出名 -> 全局槽位
+	Global  int               // 存放模块对象的全局槽位
+}
+
+func (cm *CompiledModule) Type() ObjectType { return COMPILED_MODULE_OBJ }
+func (cm *CompiledModule) Inspect() string {
+	return fmt.Sprintf("CompiledModule[%s]", cm.Name)
+}
@@ -1,7 +1,11 @@
 // object/object_test.go
 package object
 
-import "testing"
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T){
 	hello1:=&String{Value: "Hello World"}
@@ -19,4 +23,226 @@ func TestStringHashKey(t *testing.T){
 	if hello1.HashKey() == diff1.HashKey(){
 		t.Errorf("strings with different content have same hash keys")
 	}
-}
\ No newline at end of file
+}
+func TestFloatHashKey(t *testing.T) {
+	ts := []struct {
+		f     float64
+		i     int64
+		equal bool
+	}{
+		{1, 1, true},
+		{-3, -3, true},
+		{0, 0, true},
+		{math.Copysign(0, -1), 0, true},
+		{1.5, 1, false},
+		{math.Inf(1), math.MaxInt64, false},
+		{math.NaN(), 0, false},
+	}
+
+	for _, tt := range ts {
+		float := &Float{Value: tt.f}
+		integer := &Integer{Value: tt.i}
+		if (float.HashKey() == integer.HashKey()) != tt.equal {
+			t.Errorf("hash key of %v and %d: want equal=%t", tt.f, tt.i, tt.equal)
+		}
+	}
+	if (&Float{Value: 1.5}).HashKey() != (&Float{Value: 1.5}).HashKey() {
+		t.Errorf("floats with same value have different hash keys")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	ts := []struct {
+		value    float64
+		expected string
+	}{
+		{3.14, "3.14"},
+		{2, "2.0"},
+		{-0.5, "-0.5"},
+		{1e-9, "1e-09"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+	}
+
+	for _, tt := range ts {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("wrong Inspect for %g. want=%q, got=%q", tt.value, tt.expected, f.Inspect())
+		}
+	}
+}
+
+func TestFileBuiltins(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	str := func(s string) Object { return &String{Value: s} }
+	call := func(name string, args ...Object) Object {
+		return GetBuiltinByName(name).Fn(args...)
+	}
+
+	ts := []struct {
+		name     string
+		args     []Object
+		expected string // Inspect()的结果
+	}{
+		{"exists", []Object{str(file)}, "false"},
+		{"read_file", []Object{str(file)}, "ERROR: read_file: open " + file + ": no such file or directory"},
+		{"write_file", []Object{str(file), str("one\r\ntwo\n")}, "null"},
+		{"append_file", []Object{str(file), str("three\n")}, "null"},
+		{"exists", []Object{str(file)}, "true"},
+		{"read_file", []Object{str(file)}, "one\r\ntwo\nthree\n"},
+		{"read_lines", []Object{str(file)}, "[one, two, three]"},
+		{"write_file", []Object{str(filepath.Join(dir, "b.txt")), str("")}, "null"},
+		{"read_lines", []Object{str(filepath.Join(dir, "b.txt"))}, "[]"},
+		{"list_dir", []Object{str(dir)}, "[a.txt, b.txt]"},
+		{"remove", []Object{str(file)}, "null"},
+		{"list_dir", []Object{str(dir)}, "[b.txt]"},
+		{"remove", []Object{str(file)}, "ERROR: remove: remove " + file + ": no such file or directory"},
+		{"read_file", []Object{}, "ERROR: wrong number of arguments. got=0, want=1"},
+		{"read_file", []Object{&Integer{Value: 1}}, "ERROR: first argument to `read_file` must be STRING. got INTEGER"},
+		{"write_file", []Object{str(file)}, "ERROR: wrong number of arguments. got=1, want=2"},
+		{"append_file", []Object{str(file), &Integer{Value: 1}}, "ERROR: second argument to `append_file` must be STRING. got INTEGER"},
+	}
+
+	for _, tt := range ts {
+		result := call(tt.name, tt.args...)
+		if result == nil {
+			result = NULL
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.name, tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	// 标准内置函数的下标与Builtins一致
+	for i, def := range Builtins {
+		builtin, index, ok := r.Lookup(def.Name)
+		if !ok || index != i || builtin != def.Builtin {
+			t.Errorf("builtin %s: want index %d, got %d (ok=%t)", def.Name, i, index, ok)
+		}
+	}
+
+	double := func(args ...Object) Object {
+		return &Integer{Value: args[0].(*Integer).Value * 2}
+	}
+	if err := r.Register("double", double); err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+	builtin, index, ok := r.Lookup("double")
+	if !ok || index != len(Builtins) || r.Get(index) != builtin {
+		t.Fatalf("double: want index %d, got %d (ok=%t)", len(Builtins), index, ok)
+	}
+	if result := builtin.Fn(&Integer{Value: 21}); result.Inspect() != "42" {
+		t.Errorf("double(21): want 42, got %s", result.Inspect())
+	}
+
+	// 替换同名函数保持原有下标
+	if err := r.Register("len", double); err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+	if _, index, _ := r.Lookup("len"); index != 0 {
+		t.Errorf("len: want index 0 after replace, got %d", index)
+	}
+	if GetBuiltinByName("len") == r.Get(0) {
+		t.Errorf("replacing len changed the standard builtin")
+	}
+	if r.Get(-1) != nil || r.Get(len(r.Names())) != nil {
+		t.Errorf("Get out of range should return nil")
+	}
+
+	ts := []struct {
+		name        string
+		expectedErr string
+	}{
+		{"", `invalid builtin name ""`},
+		{"two words", `invalid builtin name "two words"`},
+		{"x1", `invalid builtin name "x1"`},
+		{"let", `invalid builtin name "let"`},
+	}
+	for _, tt := range ts {
+		err := r.Register(tt.name, double)
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("Register(%q): want error %q, got %v", tt.name, tt.expectedErr, err)
+		}
+	}
+
+	full := NewRegistry()
+	for i := len(full.Names()); i < MaxBuiltins; i++ {
+		name := ""
+		for n := i; ; n /= 26 {
+			name += string(rune('a' + n%26))
+			if n < 26 {
+				break
+			}
+		}
+		if err := full.Register("host_"+name, double); err != nil {
+			t.Fatalf("register error: %s", err)
+		}
+	}
+	if err := full.Register("one_more", double); err == nil || err.Error() != "too many builtins (max 256)" {
+		t.Errorf("want too many builtins error, got %v", err)
+	}
+}
+
+func TestRegistryRestrict(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterWithCapability("now", CapTime, func(args ...Object) Object { return &Integer{Value: 0} })
+
+	sandbox := r.Restrict(CapEnv)
+	ts := []struct {
+		name        string
+		expectedErr string
+	}{
+		{"len", ""},
+		{"getenv", ""},
+		{"puts", "permission denied: puts requires the io capability"},
+		{"read_file", "permission denied: read_file requires the io capability"},
+		{"exit", "permission denied: exit requires the process capability"},
+		{"now", "permission denied: now requires the time capability"},
+	}
+
+	for _, tt := range ts {
+		_, index, ok := sandbox.Lookup(tt.name)
+		if !ok {
+			t.Fatalf("%s not found", tt.name)
+		}
+		// 下标与原注册表一致
+		if _, original, _ := r.Lookup(tt.name); original != index {
+			t.Errorf("%s: index changed from %d to %d", tt.name, original, index)
+		}
+
+		err := sandbox.Permitted(index)
+		if tt.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("%s: want error %q, got %v", tt.name, tt.expectedErr, err)
+		}
+		if r.Permitted(index) != nil {
+			t.Errorf("%s: unrestricted registry should permit everything", tt.name)
+		}
+		// 调用时的检查与Permitted一致
+		builtin, _, _ := r.Lookup(tt.name)
+		if err := sandbox.Authorize(builtin); err == nil || err.Error() != tt.expectedErr {
+			t.Errorf("%s: Authorize: want error %q, got %v", tt.name, tt.expectedErr, err)
+		}
+	}
+
+	// 不能通过再次Restrict扩大权限
+	_, index, _ := r.Lookup("puts")
+	if sandbox.Restrict(CapIO, CapEnv).Permitted(index) == nil {
+		t.Errorf("Restrict should not widen permissions")
+	}
+	// 副本上注册不影响原注册表
+	sandbox.Register("extra", func(args ...Object) Object { return nil })
+	if _, _, ok := r.Lookup("extra"); ok {
+		t.Errorf("registering on a restricted copy changed the original")
+	}
+}
@@ -0,0 +1,167 @@
+package object
+
+import (
+	"fmt"
+	"malang/token"
+)
+
+// OpGetBuiltin的操作数只有一个字节
+const MaxBuiltins = 256
+
+// 内置函数需要的权限,用于在沙箱中限制脚本能做的事
+type Capability string
+
+const (
+	CapNone    Capability = ""        // 没有副作用
+	CapIO      Capability = "io"      // 读写文件和标准输出
+	CapEnv     Capability = "env"     // 读取环境变量
+	CapProcess Capability = "process" // 命令行参数和退出进程
+	CapTime    Capability = "time"    // 读取时间
+)
+
+// 使用了没有授权的内置函数
+type PermissionError struct {
+	Builtin    string
+	Capability Capability
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: %s requires the %s capability", e.Builtin, e.Capability)
+}
+
+// 内置函数注册表
+// 字节码中的内置函数按注册表中的下标引用,编译和执行需要使用相同的注册表
+// 标准内置函数总是排在前面,宿主程序注册的函数追加在后面,因此标准内置函数的下标保持不变
+type Registry struct {
+	names    []string
+	builtins []*Builtin
+	index    map[string]int
+
+	allowed map[Capability]bool // 授权的权限,nil表示全部允许
+}
+
+// 创建包含所有标准内置函数的注册表
+func NewRegistry() *Registry {
+	r := &Registry{index: make(map[string]int)}
+	for _, def := range Builtins {
+		r.add(def.Name, def.Builtin)
+	}
+	return r
+}
+
+func (r *Registry) add(name string, builtin *Builtin) {
+	r.index[name] = len(r.names)
+	r.names = append(r.names, name)
+	r.builtins = append(r.builtins, builtin)
+}
+
+// 注册内置函数,同名函数会被替换且保持原有下标
+func (r *Registry) Register(name string, fn BuiltinFunction) error {
+	return r.RegisterWithCapability(name, CapNone, fn)
+}
+
+// 注册需要权限的内置函数
+func (r *Registry) RegisterWithCapability(name string, capability Capability, fn BuiltinFunction) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid builtin name %q", name)
+	}
+
+	builtin := &Builtin{Fn: fn, Capability: capability}
+	if i, ok := r.index[name]; ok {
+		r.builtins[i] = builtin
+		return nil
+	}
+	if len(r.names) >= MaxBuiltins {
+		return fmt.Errorf("too many builtins (max %d)", MaxBuiltins)
+	}
+	r.add(name, builtin)
+	return nil
+}
+
+// 设置args()返回的命令行参数,只影响这个注册表
+func (r *Registry) SetArgs(args []string) {
+	r.builtins[r.index["args"]] = argsBuiltin(args)
+}
+
+// 根据名称查找内置函数及其下标
+func (r *Registry) Lookup(name string) (*Builtin, int, bool) {
+	i, ok := r.index[name]
+	if !ok {
+		return nil, 0, false
+	}
+	return r.builtins[i], i, true
+}
+
+// 根据下标获取内置函数,越界时返回nil
+func (r *Registry) Get(index int) *Builtin {
+	if index < 0 || index >= len(r.builtins) {
+		return nil
+	}
+	return r.builtins[index]
+}
+
+// 返回只授权了allowed中权限的注册表副本,内置函数的下标不变
+// 没有授权的内置函数在编译时是未定义的变量,执行时使用会返回*PermissionError
+func (r *Registry) Restrict(allowed ...Capability) *Registry {
+	restricted := &Registry{
+		names:    append([]string(nil), r.names...),
+		builtins: append([]*Builtin(nil), r.builtins...),
+		index:    make(map[string]int, len(r.index)),
+		allowed:  make(map[Capability]bool),
+	}
+	for name, i := range r.index {
+		restricted.index[name] = i
+	}
+	for _, capability := range allowed {
+		// 已经受限的注册表不能再扩大权限
+		if r.allowed == nil || r.allowed[capability] {
+			restricted.allowed[capability] = true
+		}
+	}
+	return restricted
+}
+
+// 检查下标对应的内置函数是否已授权
+func (r *Registry) Permitted(index int) error {
+	builtin := r.Get(index)
+	if builtin == nil || builtin.Capability == CapNone || r.allowed == nil || r.allowed[builtin.Capability] {
+		return nil
+	}
+	return &PermissionError{Builtin: r.names[index], Capability: builtin.Capability}
+}
+
+// 检查是否可以调用内置函数,在调用时检查,
+// 因此在限制权限之前取得并保存在变量中的内置函数同样受限制
+func (r *Registry) Authorize(builtin *Builtin) error {
+	if builtin.Capability == CapNone || r.allowed == nil || r.allowed[builtin.Capability] {
+		return nil
+	}
+
+	name := "builtin"
+	for i, b := range r.builtins {
+		if b == builtin {
+			name = r.names[i]
+			break
+		}
+	}
+	return &PermissionError{Builtin: name, Capability: builtin.Capability}
+}
+
+// 按下标顺序返回所有内置函数的名称
+func (r *Registry) Names() []string {
+	return append([]string(nil), r.names...)
+}
+
+// 与词法分析器的标识符规则一致:由字母或下划线组成,且不是关键字
+func isIdentifier(name string) bool {
+	if name == "" || token.LookupIdent(name) != token.IDENT {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_') {
+			return false
+		}
+	}
+	return true
+}
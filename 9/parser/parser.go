@@ -12,12 +12,13 @@ import (
 const (
 	_ int = iota // 0
 	LOWEST
+	ASSIGN     // = or += or -= or *= or /=
 	OR         // ||
 	AND        // &&
 	EQUALS     // ==
-	LESSGEATER // > or <
-	SUM        // +
-	PRODUCT    // *
+	LESSGEATER // > or < or >= or <=
+	SUM        // + or | or ^
+	PRODUCT    // * or % or & or << or >>
 	PREFIX     // -X or !X
 	CALL       // myFunction(X)
 	INDEX      // array[index]
@@ -25,18 +26,32 @@ const (
 
 // 优先级map
 var precedences = map[token.TokenType]int{
-	token.OR:       OR,
-	token.AND:      AND,
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGEATER,
-	token.GT:       LESSGEATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:          ASSIGN,
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.OR:              OR,
+	token.AND:             AND,
+	token.EQ:              EQUALS,
+	token.NOT_EQ:          EQUALS,
+	token.LT:              LESSGEATER,
+	token.GT:              LESSGEATER,
+	token.LT_EQ:           LESSGEATER,
+	token.GT_EQ:           LESSGEATER,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.BIT_OR:          SUM,
+	token.BIT_XOR:         SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.PERCENT:         PRODUCT,
+	token.BIT_AND:         PRODUCT,
+	token.SHL:             PRODUCT,
+	token.SHR:             PRODUCT,
+	token.LPAREN:          CALL,
+	token.LBRACKET:        INDEX,
+	token.DOT:             INDEX,
 }
 
 type (
@@ -54,6 +69,11 @@ type Parser struct {
 	// 解析函数
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	// 当前所处的循环层数,用于检查break/continue是否在循环内
+	loopDepth int
+	// 当前所处的块层数,export只能出现在顶层
+	blockDepth int
 }
 
 // 查询下一个词法单元的优先级
@@ -93,8 +113,22 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorAt(p.curToken.Pos, "could not parse %q as integer", p.curToken.Literal)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+// 解析函数-浮点数字面量-前缀
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		p.errorAt(p.curToken.Pos, "could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
 
@@ -136,6 +170,29 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// 解析函数-赋值表达式-中缀
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+	expression := &ast.AssignExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Target:   left,
+	}
+
+	// 只能给变量或索引表达式赋值
+	switch left.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		p.errorAt(p.curToken.Pos, "invalid assignment target %s", left.String())
+		return nil
+	}
+
+	p.nextToken()
+	// 赋值是右结合的,a = b = 1 等价于 a = (b = 1)
+	expression.Value = p.parseExpression(ASSIGN - 1)
+
+	return expression
+}
+
 // 解析函数-布尔字面量-前缀
 func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
@@ -161,6 +218,9 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 
 	p.nextToken()
 
+	p.blockDepth++
+	defer func() { p.blockDepth-- }()
+
 	// !}
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
@@ -258,7 +318,11 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
+	// 函数体是新的上下文,外层循环的break/continue不能穿透函数
+	loopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = loopDepth
 
 	return lit
 }
@@ -353,16 +417,41 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 
 // 解析函数-注释-前缀
 func (p *Parser) parseCommentLiteral() ast.Expression {
-	return &ast.StringLiteral{Value: p.curToken.Literal}
+	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
 // 解析函数-导入-前缀
 func (p *Parser) parseUseLiteral() ast.Expression {
 	// 只需要导入,不需要求值
-	use := p.curToken
+	use := &ast.UseExpression{Token: p.curToken}
 	p.nextToken()
-	f := p.curToken.Literal + ".mal"
-	return &ast.UseExpression{Token: use, FileName: f}
+	use.FileName = p.curToken.Literal + ".mal"
+	if p.curTokenIs(token.IDENT) {
+		use.Name = p.curToken.Literal
+	}
+
+	// use foo as f,as不是关键字,只在这里有特殊含义
+	if p.peekTokenIs(token.IDENT) && p.peekToken.Literal == "as" {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		use.Name = p.curToken.Literal
+	}
+
+	return use
+}
+
+// 解析函数-成员访问-中缀,f.name 等价于 f["name"]
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	exp.Index = &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
+
+	return exp
 }
 
 // 解析函数-哈希表-前缀
@@ -420,19 +509,92 @@ func (p *Parser) parseForExpression() ast.Expression {
 	}
 
 	// 解析块内语句
+	p.loopDepth++
 	expression.Body = p.parseBlockStatement()
+	p.loopDepth--
 
 	return expression
 }
 
 // 解析函数-break-前缀
 func (p *Parser) parseBreakStatement() ast.Expression {
-	return &ast.BreakExpression{}
+	if p.loopDepth == 0 {
+		p.errorAt(p.curToken.Pos, "break outside of loop")
+	}
+	return &ast.BreakExpression{Token: p.curToken}
 }
 
 // 解析函数-continue-前缀
 func (p *Parser) parseContinueStatement() ast.Expression {
-	return &ast.ContinueExpression{}
+	if p.loopDepth == 0 {
+		p.errorAt(p.curToken.Pos, "continue outside of loop")
+	}
+	return &ast.ContinueExpression{Token: p.curToken}
+}
+
+// 解析函数-try-前缀
+// try { } catch (e) { } finally { },catch的(e)可以省略
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expression.Block = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+
+		if p.peekTokenIs(token.LPAREN) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			expression.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+		}
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Finally = p.parseBlockStatement()
+	}
+
+	if expression.Catch == nil && expression.Finally == nil {
+		p.errorAt(expression.Token.Pos, "try without catch or finally")
+		return nil
+	}
+
+	return expression
+}
+
+// throw语句
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
 }
 
 // 创建解析器
@@ -443,6 +605,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
@@ -458,6 +621,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.FOR, p.parseForExpression)
 	p.registerPrefix(token.BREAK, p.parseBreakStatement)
 	p.registerPrefix(token.CONTINUE, p.parseContinueStatement)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -468,10 +632,24 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfix(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfix(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
 	p.registerInfix(token.AND, p.parseInfixExpression)
 	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseAssignExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseMemberExpression)
 
 	// 读取两个词法单元,设置peekToken和curToken
 	p.nextToken()
@@ -484,10 +662,15 @@ func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// 记录带源码位置的error
+func (p *Parser) errorAt(pos token.Position, format string, a ...interface{}) {
+	msg := fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, a...))
+	p.errors = append(p.errors, msg)
+}
+
 // 记录error
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.errorAt(p.peekToken.Pos, "expected next token to be %s, got %s instead", t, p.peekToken.Type)
 }
 
 func (p *Parser) nextToken() {
@@ -541,7 +724,7 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
 		fl.Name = stmt.Name.Value
 	}
-	
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -557,7 +740,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 
 	stmt.ReturnValue = p.parseExpression(LOWEST)
 
-	for p.curTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
 
@@ -566,8 +749,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 
 // 无法解析的语句
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.errorAt(p.curToken.Pos, "no prefix parse function for %s found", t)
 }
 
 // 解析表达式
@@ -621,12 +803,34 @@ func (p *Parser) parseStatement() ast.Statement {
 	// 遇到return开头就解析return语句
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.EXPORT:
+		return p.parseExportStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
 	// 解析表达式
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
+// 解析export let语句,只能出现在顶层
+func (p *Parser) parseExportStatement() ast.Statement {
+	if p.blockDepth > 0 {
+		p.errorAt(p.curToken.Pos, "export is only allowed at the top level")
+		return nil
+	}
+	if !p.expectPeek(token.LET) {
+		return nil
+	}
+
+	stmt := p.parseLetStatement()
+	if stmt == nil {
+		return nil
+	}
+	stmt.Exported = true
+	return stmt
+}
+
 // 解析源码,构建AST
 func (p *Parser) ParseProgram() *ast.Program {
 	// 构造根节点
@@ -139,6 +139,43 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{"0.5", 0.5},
+		{"1e-9", 1e-9},
+		{"2.5E+3", 2500},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has not enough statements. got=%d",
+				len(program.Statements))
+		}
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+				program.Statements[0])
+		}
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestParsingPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input    string
@@ -289,6 +326,50 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"3 + 4 * 5 == 3 * 1 + 4 * 5",
 			"((3 + (4 * 5)) == ((3 * 1) + (4 * 5)))",
 		},
+		{
+			"a < b && c > d",
+			"((a < b) && (c > d))",
+		},
+		{
+			"a == b || c != d",
+			"((a == b) || (c != d))",
+		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"!a && b",
+			"((!a) && b)",
+		},
+		{
+			"a + b % c",
+			"(a + (b % c))",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a | b & c",
+			"(a | (b & c))",
+		},
+		{
+			"a ^ b << 2",
+			"(a ^ (b << 2))",
+		},
+		{
+			"a & b == c",
+			"((a & b) == c)",
+		},
+		{
+			"1 + 2 >> 1",
+			"(1 + (2 >> 1))",
+		},
 		{
 			"true",
 			"true",
@@ -1071,3 +1152,271 @@ func TestFunctionLiteralWithName(t *testing.T) {
 		t.Fatalf("function literal name wrong. wnat 'myFunction', got=%q\n", function.Name)
 	}
 }
+
+func TestBreakContinueOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"break", "1:1: break outside of loop"},
+		{"continue", "1:1: continue outside of loop"},
+		{"for (true) { fn() { break; } }", "1:21: break outside of loop"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != 1 {
+			t.Fatalf("parser has %d errors, want 1: %q", len(errors), errors)
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong parser error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+
+	l := lexer.New("for (true) { if (true) { break; } continue; }")
+	p := New(l)
+	p.ParseProgram()
+	checkParserErrors(t, p)
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"let = 5;", "main.mal:1:5: expected next token to be IDENT, got = instead"},
+		{"let x = 1;\nlet y 2;", "main.mal:2:7: expected next token to be =, got INT instead"},
+		{"let x = 1;\n\n  * 2", "main.mal:3:3: no prefix parse function for * found"},
+		{"if (true) {\n\tx\n} else (", "main.mal:3:8: expected next token to be {, got ( instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewWithFile("main.mal", tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong parser error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	input := "let x = 1;\n  add(x, 2) + y[0];"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[1].(*ast.ExpressionStatement)
+	infix := stmt.Expression.(*ast.InfixExpression)
+	call := infix.Left.(*ast.CallExpression)
+	index := infix.Right.(*ast.IndexExpression)
+
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{program.Statements[0], "1:1"},
+		{program.Statements[0].(*ast.LetStatement).Value, "1:9"},
+		{stmt, "2:3"},
+		{infix, "2:3"},
+		{call, "2:3"},
+		{call.Arguments[1], "2:10"},
+		{index, "2:15"},
+		{index.Index, "2:17"},
+	}
+
+	for i, tt := range tests {
+		if tt.node.Pos().String() != tt.expected {
+			t.Errorf("tests[%d] - wrong position for %q. want=%s, got=%s",
+				i, tt.node.String(), tt.expected, tt.node.Pos())
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5", "(x = 5)"},
+		{"x += 1 * 2", "(x += (1 * 2))"},
+		{"x -= y || z", "(x -= (y || z))"},
+		{"x *= 2; x /= 2", "(x *= 2)(x /= 2)"},
+		{"a = b = 1", "(a = (b = 1))"},
+		{"let y = x = 3", "let y = (x = 3);"},
+		{"fn() { x = x + 1 }", "fn() (x = (x + 1))"},
+		{"a[1] = 2", "((a[1]) = 2)"},
+		{"h[\"k\"] += 1", "((h[k]) += 1)"},
+		{"a[i][j] = b[j]", "(((a[i])[j]) = (b[j]))"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	l := lexer.New("x = 5;")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.AssignExpression)
+	if !ok {
+		t.Fatalf("exp is not ast.AssignExpression. got=%T", stmt.Expression)
+	}
+	if !testIdentifier(t, exp.Target, "x") {
+		return
+	}
+	if exp.Operator != "=" {
+		t.Errorf("exp.Operator is not '='. got=%q", exp.Operator)
+	}
+	testIntegerLiteral(t, exp.Value, 5)
+}
+
+func TestInvalidAssignTarget(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"1 = 2", "1:3: invalid assignment target 1"},
+		{"f() += 1", "1:5: invalid assignment target f()"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong parser error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestUseAndExport(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"use foo", "use foo.mal as foo"},
+		{"use foo as f", "use foo.mal as f"},
+		{"use 2", "use 2.mal"},
+		{"use 2 as two", "use 2.mal as two"},
+		{"export let x = 1;", "export let x = 1;"},
+		{"f.name", "(f[name])"},
+		{"f.g(1).h", "((f[g])(1)[h])"},
+		{"a.b.c = 1", "(((a[b])[c]) = 1)"},
+		{"let as = 1; as", "let as = 1;as"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	errorTests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"fn() { export let x = 1; }", "1:8: export is only allowed at the top level"},
+		{"if (true) { export let x = 1 }", "1:13: export is only allowed at the top level"},
+		{"export 1", "1:8: expected next token to be LET, got INT instead"},
+		{"f.1", "1:3: expected next token to be IDENT, got INT instead"},
+		{"use foo as 1", "1:12: expected next token to be IDENT, got INT instead"},
+	}
+
+	for _, tt := range errorTests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong parser error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestTryAndThrow(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { a } catch (e) { b }", "try a catch (e) b"},
+		{"try { a } catch { b }", "try a catch b"},
+		{"try { a } finally { b }", "try a finally b"},
+		{"try { a } catch (e) { b } finally { c }", "try a catch (e) b finally c"},
+		{"let x = try { 1 } catch { 2 };", "let x = try 1 catch 2;"},
+		{"throw 1 + 2;", "throw (1 + 2);"},
+		{"throw x", "throw x;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	errorTests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"try { a }", "1:1: try without catch or finally"},
+		{"try a catch { b }", "1:5: expected next token to be {, got IDENT instead"},
+		{"try { a } catch (1) { b }", "1:18: expected next token to be IDENT, got INT instead"},
+		{"try { a } catch (e { b }", "1:20: expected next token to be ), got { instead"},
+	}
+
+	for _, tt := range errorTests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong parser error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
@@ -11,19 +11,30 @@ void pf(){
 import "C"
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"malang/compiler"
 	"malang/evaluator"
 	"malang/lexer"
+	"malang/module"
 	"malang/object"
 	"malang/parser"
-	"malang/util"
+	"malang/std"
 	"malang/vm"
+	"strings"
 )
 
 const PROMPT = ">> "
 
+// 编译时是否优化字节码
+var optimize = true
+
+// 设置编译时是否优化字节码,默认开启
+func SetOptimize(enabled bool) {
+	optimize = enabled
+}
+
 const MONKEY_FACE = `            __,__
    .--.  .-"     "-.  .--.
   / .. \/  .-. .-.  \/ .. \
@@ -109,8 +120,7 @@ func Start(in io.Reader, out io.Writer) {
 	env := object.NewEnvironment()
 	io.WriteString(out, MALRED_LOGO)
 	// 加载标准库
-	std := util.LoadStd()
-	l := lexer.New(std)
+	l := lexer.New(std.Source)
 	p := parser.New(l)
 	program := p.ParseProgram()
 	evaluator.Eval(program, env)
@@ -133,6 +143,9 @@ func Start(in io.Reader, out io.Writer) {
 		}
 
 		evaluated := evaluator.Eval(program, env)
+		if _, ok := evaluated.(*object.Exit); ok {
+			return
+		}
 		if evaluated != nil {
 			io.WriteString(out, evaluated.Inspect())
 			io.WriteString(out, "\n")
@@ -145,11 +158,10 @@ func StartVM(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 
 	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalsSize)
+	globals := vm.NewGlobals()
+	verifier := compiler.NewVerifier()
 	symbolTable := compiler.NewSymbolTable()
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
-	}
+	symbolTable.DefineBuiltins(object.NewRegistry())
 
 	for {
 		fmt.Fprintf(out, PROMPT)
@@ -169,9 +181,12 @@ func StartVM(in io.Reader, out io.Writer) {
 		}
 
 		// 求值不同
+		state := symbolTable.Save()
 		comp := compiler.NewWithState(symbolTable, constants)
+		comp.SetOptimize(optimize)
 		err := comp.Compile(program)
 		if err != nil {
+			symbolTable.Restore(state)
 			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
 			continue
 		}
@@ -180,9 +195,16 @@ func StartVM(in io.Reader, out io.Writer) {
 		constants = code.Constants
 
 		machine := vm.NewWithState(code, globals)
+		machine.SetVerifier(verifier)
 		err = machine.Run()
+		if _, ok := err.(*object.Exit); ok {
+			return
+		}
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+			if rtErr, ok := err.(*vm.RuntimeError); ok {
+				io.WriteString(out, rtErr.StackTrace())
+			}
 			continue
 		}
 
@@ -201,20 +223,83 @@ func printParserErrors(out io.Writer, errors []string) {
 	}
 }
 
-func ReadAndEval(input string) {
-	std := util.LoadStd()
-	l := lexer.New(std + input)
-	p := parser.New(l)
+// 用树遍历求值器执行文件,返回语法错误或运行时错误
+// args为args()返回的命令行参数
+func ReadAndEval(file string, input string, searchPath []string, args []string) error {
+	registry := object.NewRegistry()
+	registry.SetArgs(args)
+
 	env := object.NewEnvironment()
+	env.SetModuleLoader(module.NewLoader(searchPath))
+	env.SetRegistry(registry)
+
+	// 标准库单独解析,保证用户文件中的行号正确
+	l := lexer.NewWithFile("std/std.mal", std.Source)
+	p := parser.New(l)
+	evaluator.Eval(p.ParseProgram(), env)
+
+	l = lexer.NewWithFile(file, input)
+	p = parser.New(l)
 	program := p.ParseProgram()
-	if len(p.Errors()) != 0 {
-		fmt.Println(MALRED_LOGO_IMG)
-		fmt.Println(ERROR_LOGO)
-		fmt.Println("Woops! We ran into some monkey business here!\n")
-		for _, msg := range p.Errors() {
-			fmt.Println("\t" + msg + "\n")
+	if errs := p.Errors(); len(errs) != 0 {
+		return fmt.Errorf("parse errors:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	evaluated := evaluator.Eval(program, env)
+	if exit, ok := evaluated.(*object.Exit); ok {
+		return exit
+	}
+	if errObj, ok := evaluated.(*object.Error); ok {
+		if errObj.Pos.IsValid() {
+			return fmt.Errorf("%s: %s", errObj.Pos, errObj.Message)
 		}
+		return errors.New(errObj.Message)
 	}
-	evaluator.Eval(program, env)
-	// fmt.Printf(">> %v\n", evaluator.Eval(pro, env).Inspect())
+	return nil
+}
+
+// 编译文件并在虚拟机中执行,返回语法、编译或运行时错误
+func ReadAndRun(file string, input string, searchPath []string, args []string) error {
+	bytecode, err := CompileFile(file, input, searchPath)
+	if err != nil {
+		return err
+	}
+	return RunBytecode(bytecode, args)
+}
+
+// 把源文件(连同标准库)编译为字节码
+func CompileFile(file string, input string, searchPath []string) (*compiler.Bytecode, error) {
+	comp := compiler.New()
+	comp.SetModuleLoader(module.NewLoader(searchPath))
+	comp.SetOptimize(optimize)
+
+	// 标准库单独解析,保证用户文件中的行号正确
+	sources := []struct{ file, input string }{
+		{"std/std.mal", std.Source},
+		{file, input},
+	}
+	for _, src := range sources {
+		p := parser.New(lexer.NewWithFile(src.file, src.input))
+		program := p.ParseProgram()
+		if errs := p.Errors(); len(errs) != 0 {
+			return nil, fmt.Errorf("parse errors:\n\t%s", strings.Join(errs, "\n\t"))
+		}
+
+		err := comp.Compile(program)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return comp.Bytecode(), nil
+}
+
+// 在虚拟机中执行字节码,运行时错误为*vm.RuntimeError,带有调用栈
+// args为args()返回的命令行参数
+func RunBytecode(bytecode *compiler.Bytecode, args []string) error {
+	registry := object.NewRegistry()
+	registry.SetArgs(args)
+
+	machine := vm.New(bytecode)
+	machine.SetRegistry(registry)
+	return machine.Run()
 }
@@ -0,0 +1,9 @@
+// std/std.go
+package std
+
+import _ "embed"
+
+// 标准库源码,编译进程序中,嵌入使用时不依赖工作目录
+//
+//go:embed std.mal
+var Source string
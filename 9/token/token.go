@@ -1,6 +1,8 @@
 // token/token.go
 package token
 
+import "fmt"
+
 const (
 	// 特殊类型
 	ILLEGAL = "ILLEGAL" // 未知字符
@@ -10,6 +12,7 @@ const (
 	// 标识符+字面量
 	IDENT  = "IDENT"  // add, foobar, x, y
 	INT    = "INT"    // 1343456
+	FLOAT  = "FLOAT"  // 3.14, 1e-9
 	STRING = "STRING" // "hello"
 
 	// 运算符
@@ -19,11 +22,27 @@ const (
 	BANG     = "!"
 	ASTERISK = "*"
 	SLASH    = "/"
+	PERCENT  = "%"
 	AND      = "&&"
 	OR       = "||"
 
-	LT = "<"
-	GT = ">"
+	// 复合赋值
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
+
+	// 位运算
+	BIT_AND = "&"
+	BIT_OR  = "|"
+	BIT_XOR = "^"
+	SHL     = "<<"
+	SHR     = ">>"
+
+	LT    = "<"
+	GT    = ">"
+	LT_EQ = "<="
+	GT_EQ = ">="
 
 	EQ     = "=="
 	NOT_EQ = "!="
@@ -32,6 +51,7 @@ const (
 	COMMA     = ","
 	SEMICOLON = ";"
 	COLON     = ":"
+	DOT       = "."
 
 	LPAREN   = "("
 	RPAREN   = ")"
@@ -49,10 +69,15 @@ const (
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
 	USE      = "USE"
-	FOR      = "FOR"      // TODO
-	RANGE    = "RANGE"    // TODO
-	BREAK    = "break"    // TODO
-	CONTINUE = "continue" // TODO
+	FOR      = "FOR"
+	RANGE    = "RANGE" // TODO
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	EXPORT   = "EXPORT"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
 )
 
 // 关键字map
@@ -69,6 +94,11 @@ var keywords = map[string]TokenType{
 	"range":    RANGE,
 	"break":    BREAK,
 	"continue": CONTINUE,
+	"export":   EXPORT,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -83,9 +113,31 @@ func LookupIdent(ident string) TokenType {
 // 词法单元类型
 type TokenType string
 
+// 源码位置
+type Position struct {
+	File   string // 文件名,repl等没有文件的输入为空
+	Line   int    // 行号,从1开始
+	Column int    // 列号,从1开始
+}
+
+// 位置是否有效(没有经过词法分析器的节点行号为0)
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// 格式为 file:line:col,没有文件名时为 line:col
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
 // 词法单元
 type Token struct {
 	Type TokenType
 	// 字面量
 	Literal string
+	// 词法单元第一个字符在源码中的位置
+	Pos Position
 }
@@ -7,14 +7,14 @@ import (
 	"malang/parser"
 )
 
-// 加载标准库
-func LoadStd() string {
-	// todo: 改为循环读取std目录
+// 从当前目录读取标准库源码,文件不存在时返回错误
+// 执行脚本使用编译进程序的std.Source,不依赖工作目录
+func LoadStd() (string, error) {
 	buf, err := ioutil.ReadFile("./std/std.mal")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return string(buf)
+	return string(buf), nil
 }
 
 // 加载用户定义的文件(返回加载后的字符串)
@@ -23,7 +23,7 @@ func LoadMalFile(filePath string) *ast.Program {
 	if err != nil {
 		panic(err)
 	}
-	l := lexer.New(string(buf))
+	l := lexer.NewWithFile(filePath, string(buf))
 	p := parser.New(l)
 	return p.ParseProgram()
 }
@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"malang/object"
+	"malang/token"
+)
+
+// 调用栈中的一帧
+type StackFrame struct {
+	Function string         // 函数名
+	Pos      token.Position // 该帧正在执行的指令对应的源码位置
+}
+
+func (sf StackFrame) String() string {
+	if !sf.Pos.IsValid() {
+		return sf.Function
+	}
+	return fmt.Sprintf("%s (%s)", sf.Function, sf.Pos)
+}
+
+// 虚拟机运行时错误,附带出错时的调用栈
+type RuntimeError struct {
+	Message string
+	Stack   []StackFrame // 最内层(出错)的帧在前
+	Err     error        // 原始错误,如ErrStackOverflow或context.Canceled
+}
+
+func (e *RuntimeError) Error() string {
+	if len(e.Stack) > 0 && e.Stack[0].Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Stack[0].Pos, e.Message)
+	}
+	return e.Message
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// 可读的调用栈
+func (e *RuntimeError) StackTrace() string {
+	var out bytes.Buffer
+
+	out.WriteString("stack trace:\n")
+	for _, frame := range e.Stack {
+		out.WriteString("\tat " + frame.String() + "\n")
+	}
+
+	return out.String()
+}
+
+// throw抛出的值
+type thrownError struct {
+	value object.Object
+}
+
+func (e *thrownError) Error() string {
+	return "uncaught exception: " + e.value.Inspect()
+}
+
+// 尝试把错误交给最近的异常处理器,返回false表示没有处理器或错误不可捕获
+// 捕获后弹出处理器所在帧之上的栈帧,恢复栈指针,把异常值压栈并跳转到catch
+func (vm *VM) handleException(err error) bool {
+	if !catchable(err) {
+		return false
+	}
+
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		if len(frame.handlers) == 0 {
+			continue
+		}
+
+		h := frame.handlers[len(frame.handlers)-1]
+		frame.handlers = frame.handlers[:len(frame.handlers)-1]
+
+		vm.framesIndex = i + 1
+		vm.sp = h.sp
+		if vm.push(exceptionValue(err)) != nil {
+			return false
+		}
+		// run在执行下一条指令前会先把ip加一
+		frame.ip = h.target - 1
+		return true
+	}
+	return false
+}
+
+// exit()和执行限制不能被脚本捕获
+func catchable(err error) bool {
+	if _, ok := err.(*object.Exit); ok {
+		return false
+	}
+	return !errors.Is(err, ErrInstructionLimit) && !errors.Is(err, ErrObjectLimit) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// catch得到的值:throw抛出的值,运行时错误则是错误信息字符串
+func exceptionValue(err error) object.Object {
+	if thrown, ok := err.(*thrownError); ok {
+		return thrown.value
+	}
+	return &object.String{Value: err.Error()}
+}
+
+// 用当前所有活动的栈帧包装错误
+func (vm *VM) newRuntimeError(err error) *RuntimeError {
+	stack := make([]StackFrame, 0, vm.framesIndex)
+
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		fn := frame.cl.Fn
+
+		name := fn.Name
+		if i == 0 {
+			name = "<main>"
+		} else if name == "" {
+			name = "<anonymous>"
+		}
+
+		pos, _ := fn.SourceMap.Lookup(frame.ip)
+		stack = append(stack, StackFrame{Function: name, Pos: pos})
+	}
+
+	return &RuntimeError{Message: err.Error(), Stack: stack, Err: err}
+}
@@ -9,6 +9,14 @@ type Frame struct {
 	cl          *object.Closure
 	ip          int
 	basePointer int
+
+	handlers []handler // OpTry登记的异常处理器,最内层的在最后
+}
+
+// 异常处理器
+type handler struct {
+	target int // catch的位置
+	sp     int // 登记时的栈指针,捕获异常时恢复
 }
 
 func NewFrame(cl *object.Closure, basePointer int) *Frame {
@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"malang/compiler"
+	"malang/object"
+)
+
+// 全局槽位最多这么多个
+const GlobalsSize = compiler.MaxGlobals
+
+// 全局变量存储,按编译器定义的全局槽位数分配,不够时自动增长
+// repl和嵌入的Runtime在多次执行之间共享同一个Globals,
+// 模块对象也通过它读取导出的变量,因此增长后仍能看到最新的值
+type Globals struct {
+	values []object.Object
+}
+
+// 创建空的全局变量存储
+func NewGlobals() *Globals {
+	return &Globals{}
+}
+
+// 读取全局槽位,未赋值或越界时返回nil
+func (g *Globals) Get(index int) object.Object {
+	if index < 0 || index >= len(g.values) {
+		return nil
+	}
+	return g.values[index]
+}
+
+// 设置全局槽位,必要时增长
+func (g *Globals) Set(index int, obj object.Object) {
+	if index >= len(g.values) {
+		g.grow(index + 1)
+	}
+	g.values[index] = obj
+}
+
+// 保证至少有n个槽位,按倍数增长以减少复制
+func (g *Globals) grow(n int) {
+	if n <= len(g.values) {
+		return
+	}
+	if n > GlobalsSize {
+		n = GlobalsSize
+	}
+	size := 2 * len(g.values)
+	if size < n {
+		size = n
+	}
+	if size > GlobalsSize {
+		size = GlobalsSize
+	}
+	values := make([]object.Object, size)
+	copy(values, g.values)
+	g.values = values
+}
+
+// 已分配的槽位数
+func (g *Globals) Len() int {
+	return len(g.values)
+}
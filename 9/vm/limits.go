@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 超出执行限制时返回的错误,会被包装在*RuntimeError中,可以用errors.Is判断
+var (
+	ErrStackOverflow    = errors.New("stack overflow")
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrObjectLimit      = errors.New("object limit exceeded")
+)
+
+// 栈或调用栈超过上限,errors.Is(err, ErrStackOverflow)为true
+type StackOverflowError struct {
+	Depth int // 溢出时的调用深度,主程序为1
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("stack overflow (call depth %d)", e.Depth)
+}
+
+func (e *StackOverflowError) Is(target error) bool {
+	return target == ErrStackOverflow
+}
+
+func (vm *VM) stackOverflow() error {
+	return &StackOverflowError{Depth: vm.framesIndex}
+}
+
+// 每执行这么多条指令检查一次context是否已取消
+const cancelCheckInterval = 1024
+
+// 虚拟机的执行限制
+type Limits struct {
+	MaxInstructions int64 // 最多执行的指令数,0表示不限制
+	MaxObjects      int64 // 最多分配的数组、哈希、字符串、闭包等对象数,0表示不限制
+	MaxStack        int   // 操作数栈的大小上限,0表示默认的StackSize
+	MaxFrames       int   // 最大调用深度,0表示默认的MaxFrames
+}
+
+// 设置执行限制,需要在Run之前调用
+func (vm *VM) SetLimits(l Limits) {
+	if l.MaxStack <= 0 {
+		l.MaxStack = StackSize
+	}
+	if l.MaxFrames <= 0 {
+		l.MaxFrames = MaxFrames
+	}
+	vm.limits = l
+
+	// 栈按需增长,已分配的部分不能超过新的上限
+	if len(vm.stack) > l.MaxStack && vm.sp < l.MaxStack {
+		vm.stack = vm.stack[:l.MaxStack]
+	}
+	if len(vm.frames) > l.MaxFrames && vm.framesIndex <= l.MaxFrames {
+		vm.frames = vm.frames[:l.MaxFrames]
+	}
+}
+
+// 记录一次对象分配,超过MaxObjects时报错
+func (vm *VM) allocate() error {
+	vm.allocations++
+	if vm.limits.MaxObjects > 0 && vm.allocations > vm.limits.MaxObjects {
+		return ErrObjectLimit
+	}
+	return nil
+}
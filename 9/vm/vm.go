@@ -1,19 +1,40 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"malang/code"
 	"malang/compiler"
 	"malang/object"
+	"math"
+	"sort"
 )
 
-const MaxFrames = 1024
-const StackSize = 2048
-const GlobalsSize = 65535
+// 栈和调用栈的默认上限,可以用Limits修改
+// 两者都从较小的容量开始,按需增长
+const MaxFrames = 1 << 14
+const StackSize = 1 << 16
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+// 栈和调用栈的初始容量
+const (
+	initialStackSize = 256
+	initialFrames    = 64
+)
+
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
+
+// 整数溢出策略
+type OverflowPolicy int
+
+const (
+	// 按64位二进制补码回绕(默认,与求值器和Go的行为一致)
+	OverflowWrap OverflowPolicy = iota
+	// 溢出时产生运行时错误
+	OverflowError
+)
 
 type VM struct {
 	// compiler生成的常量和指令
@@ -22,19 +43,40 @@ type VM struct {
 	stack []object.Object
 	sp    int // 始终指向栈中的下一个空闲槽。栈顶的值是stack[sp-1]
 
-	globals []object.Object
+	globals *Globals
 
 	frames      []*Frame // 栈帧
 	framesIndex int
+
+	overflowPolicy OverflowPolicy // 整数溢出策略
+
+	registry *object.Registry // 内置函数注册表
+
+	limits       Limits // 执行限制
+	instructions int64  // 已执行的指令数
+	allocations  int64  // 已分配的对象数
+
+	numGlobals int                // 字节码使用的全局槽位数
+	verifier   *compiler.Verifier // 字节码校验器
+	verified   bool               // 字节码已通过校验
 }
 
 func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= len(vm.frames) {
+		if vm.framesIndex >= vm.limits.MaxFrames {
+			return vm.stackOverflow()
+		}
+		frames := make([]*Frame, growSize(len(vm.frames), vm.framesIndex+1, vm.limits.MaxFrames))
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -44,27 +86,50 @@ func (vm *VM) popFrame() *Frame {
 
 func New(bytecode *compiler.Bytecode) *VM {
 	// 用传入的字节码创建栈帧
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		SourceMap:    bytecode.SourceMap,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
-	// 预先分配切片
-	frames := make([]*Frame, MaxFrames)
+	// 栈和调用栈按需增长,全局变量按编译器定义的数量分配
+	frames := make([]*Frame, initialFrames)
 	frames[0] = mainFrame
 
 	return &VM{
 		constants: bytecode.Constants,
 
-		stack: make([]object.Object, StackSize),
+		stack: make([]object.Object, initialStackSize),
 		sp:    0,
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: &Globals{values: make([]object.Object, bytecode.NumGlobals)},
 
 		frames:      frames,
 		framesIndex: 1,
+
+		registry:   object.NewRegistry(),
+		limits:     Limits{MaxStack: StackSize, MaxFrames: MaxFrames},
+		numGlobals: bytecode.NumGlobals,
+		verifier:   compiler.NewVerifier(),
 	}
 }
 
+// 设置整数溢出策略,默认为OverflowWrap
+func (vm *VM) SetOverflowPolicy(policy OverflowPolicy) {
+	vm.overflowPolicy = policy
+}
+
+// 设置内置函数注册表,需要与编译时使用的注册表一致
+func (vm *VM) SetRegistry(r *object.Registry) {
+	vm.registry = r
+}
+
+// 设置字节码校验器,多次执行共享同一个校验器时只校验新增的常量
+func (vm *VM) SetVerifier(v *compiler.Verifier) {
+	vm.verifier = v
+}
+
 // 获取栈顶元素
 func (vm *VM) StackTop() object.Object {
 	if vm.sp == 0 {
@@ -74,6 +139,7 @@ func (vm *VM) StackTop() object.Object {
 }
 
 // 四则运算
+// 除以0是运行时错误,溢出时按vm.overflowPolicy回绕或报错
 func (vm *VM) executeBinaryIntegerOperation(
 	op code.Opcode,
 	left, right object.Object,
@@ -82,35 +148,136 @@ func (vm *VM) executeBinaryIntegerOperation(
 	rightValue := right.(*object.Integer).Value
 
 	var res int64
+	var overflow bool
 
 	switch op {
 	case code.OpAdd:
 		res = leftValue + rightValue
+		// 同号相加结果变号即溢出
+		overflow = (leftValue > 0 && rightValue > 0 && res < 0) ||
+			(leftValue < 0 && rightValue < 0 && res >= 0)
 	case code.OpSub:
 		res = leftValue - rightValue
+		// 异号相减结果与被减数异号即溢出
+		overflow = (leftValue >= 0 && rightValue < 0 && res < 0) ||
+			(leftValue < 0 && rightValue > 0 && res >= 0)
 	case code.OpMul:
 		res = leftValue * rightValue
+		overflow = leftValue != 0 &&
+			(res/leftValue != rightValue || (leftValue == -1 && rightValue == math.MinInt64))
 	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		res = leftValue / rightValue
+		overflow = leftValue == math.MinInt64 && rightValue == -1
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("modulo by zero")
+		}
+		res = leftValue % rightValue
+	// 位运算按位处理,不受溢出策略影响
+	case code.OpBitAnd:
+		res = leftValue & rightValue
+	case code.OpBitOr:
+		res = leftValue | rightValue
+	case code.OpBitXor:
+		res = leftValue ^ rightValue
+	case code.OpShiftLeft, code.OpShiftRight:
+		if rightValue < 0 {
+			return fmt.Errorf("negative shift count: %d", rightValue)
+		}
+		if op == code.OpShiftLeft {
+			res = leftValue << uint64(rightValue)
+		} else {
+			res = leftValue >> uint64(rightValue)
+		}
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
+	if overflow && vm.overflowPolicy == OverflowError {
+		return fmt.Errorf("integer overflow: %d %s %d", leftValue, binaryOperators[op], rightValue)
+	}
+
 	return vm.push(&object.Integer{Value: res})
 }
 
+// 二元运算指令对应的运算符,用于错误信息
+var binaryOperators = map[code.Opcode]string{
+	code.OpAdd:        "+",
+	code.OpSub:        "-",
+	code.OpMul:        "*",
+	code.OpDiv:        "/",
+	code.OpMod:        "%",
+	code.OpBitAnd:     "&",
+	code.OpBitOr:      "|",
+	code.OpBitXor:     "^",
+	code.OpShiftLeft:  "<<",
+	code.OpShiftRight: ">>",
+}
+
+// 是否是数字(整数或浮点数)
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+// 数字转为float64,整数会被提升为浮点数
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
+// 浮点数四则运算,整数一侧提升为浮点数
+// 浮点数除以0遵循IEEE 754,得到±Inf或NaN
+func (vm *VM) executeBinaryFloatOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	var res float64
+
+	switch op {
+	case code.OpAdd:
+		res = leftValue + rightValue
+	case code.OpSub:
+		res = leftValue - rightValue
+	case code.OpMul:
+		res = leftValue * rightValue
+	case code.OpDiv:
+		res = leftValue / rightValue
+	case code.OpMod:
+		res = math.Mod(leftValue, rightValue)
+	default:
+		// 位运算只支持整数,错误信息与求值器一致
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), binaryOperators[op], right.Type())
+	}
+
+	return vm.push(&object.Float{Value: res})
+}
+
 // 字符串四则运算
 func (vm *VM) executeBinaryStringOperation(
 	op code.Opcode,
 	left, right object.Object,
 ) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operation: %d", op)
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), binaryOperators[op], right.Type())
 	}
 
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
 
+	if err := vm.allocate(); err != nil {
+		return err
+	}
 	return vm.push(&object.String{Value: leftValue + rightValue})
 }
 
@@ -124,6 +291,8 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	switch {
 	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case isNumber(left) && isNumber(right):
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 	default:
@@ -154,8 +323,40 @@ func (vm *VM) executeIntegerComparison(
 		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), comparisonOperators[op], right.Type())
+	}
+}
+
+// 比较浮点数,整数一侧提升为浮点数
+func (vm *VM) executeFloatComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), comparisonOperators[op], right.Type())
 	}
 }
 
@@ -168,6 +369,10 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+
 	switch op {
 	// 将go的布尔类型转换成*Object.Boolean
 	case code.OpEqual:
@@ -175,20 +380,39 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	case code.OpNotEqual:
 		return vm.push(nativeBoolToBooleanObject(right != left))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+		// 错误信息与求值器一致
+		if left.Type() != right.Type() {
+			return fmt.Errorf("type mismatch: %s %s %s", left.Type(), comparisonOperators[op], right.Type())
+		}
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), comparisonOperators[op], right.Type())
 	}
 }
 
+// 比较指令对应的运算符,用于错误信息
+var comparisonOperators = map[code.Opcode]string{
+	code.OpEqual:              "==",
+	code.OpNotEqual:           "!=",
+	code.OpGreaterThan:        ">",
+	code.OpLessThan:           "<",
+	code.OpGreaterThanOrEqual: ">=",
+	code.OpLessThanOrEqual:    "<=",
+}
+
 // 正反号转换
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
+	switch operand := operand.(type) {
+	case *object.Integer:
+		if operand.Value == math.MinInt64 && vm.overflowPolicy == OverflowError {
+			return fmt.Errorf("integer overflow: -(%d)", operand.Value)
+		}
+		return vm.push(&object.Integer{Value: -operand.Value})
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
 		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
 	}
-
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
 }
 
 // 取反运算
@@ -301,6 +525,12 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 		return vm.executeArrayIndex(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
+	case left.Type() == object.MODULE_OBJ && index.Type() == object.STRING_OBJ:
+		val, err := left.(*object.Module).Member(index.(*object.String).Value)
+		if err != nil {
+			return err
+		}
+		return vm.push(val)
 	// 自己加的，对字符串索引
 	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeStringIndex(left, index)
@@ -309,6 +539,79 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	}
 }
 
+// 索引赋值,直接修改原数组/哈希,并把新值压栈
+func (vm *VM) executeSetIndex(left, index, val object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return fmt.Errorf("index out of range: %d (length %d)", i.Value, len(left.Elements))
+		}
+		left.Elements[i.Value] = val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: val}
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(val)
+}
+
+// 加载模块:第一次加载时创建模块对象并执行模块顶层代码,
+// 之后直接返回保存在全局槽位中的模块对象
+func (vm *VM) loadModule(constIndex int) error {
+	mod, ok := vm.constants[constIndex].(*object.CompiledModule)
+	if !ok {
+		return fmt.Errorf("not a module: %+v", vm.constants[constIndex])
+	}
+
+	if loaded := vm.globals.Get(mod.Global); loaded != nil {
+		return vm.push(loaded)
+	}
+
+	vm.globals.Set(mod.Global, vm.newModule(mod))
+
+	cl := &object.Closure{Fn: mod.Init}
+	err := vm.push(cl)
+	if err != nil {
+		return err
+	}
+	return vm.callClosure(cl, 0)
+}
+
+// 模块对象读取的是全局槽位中的当前值
+func (vm *VM) newModule(mod *object.CompiledModule) *object.Module {
+	exports := make([]string, 0, len(mod.Exports))
+	for name := range mod.Exports {
+		exports = append(exports, name)
+	}
+	sort.Strings(exports)
+
+	globals := vm.globals
+	return &object.Module{
+		Name:    mod.Name,
+		Exports: exports,
+		Lookup: func(name string) (object.Object, bool) {
+			index, ok := mod.Exports[name]
+			if !ok {
+				return nil, false
+			}
+			val := globals.Get(index)
+			if val == nil {
+				return Null, true
+			}
+			return val, true
+		},
+	}
+}
+
 // 调用函数
 func (vm *VM) executeCall(numArgs int) error {
 	callee := vm.stack[vm.sp-1-numArgs]
@@ -322,12 +625,83 @@ func (vm *VM) executeCall(numArgs int) error {
 	}
 }
 
+// 尾调用:被调用的闭包复用当前栈帧,调用深度不会增长
+// 内置函数按普通调用执行,之后的OpReturnValue照常返回
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	frame := vm.currentFrame()
+	if !ok || vm.framesIndex == 1 || len(frame.handlers) > 0 {
+		return vm.executeCall(numArgs)
+	}
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+
+	// 被调用的闭包和参数移动到当前闭包所在的位置,然后替换当前栈帧
+	base := frame.basePointer - 1
+	copy(vm.stack[base:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = base + 1 + numArgs
+	vm.popFrame()
+
+	return vm.callClosure(cl, numArgs)
+}
+
+// 执行字节码,运行时错误会包装为带调用栈的*RuntimeError
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// 执行字节码,ctx取消或超时时停止执行,返回包装了ctx.Err()的*RuntimeError
+// 可以被try捕获的错误不会中断执行
+// 执行前先校验字节码,格式错误时返回*compiler.VerifyError
+func (vm *VM) RunContext(ctx context.Context) error {
+	if !vm.verified {
+		err := vm.verifier.Verify(&compiler.Bytecode{
+			Instructions: vm.frames[0].Instructions(),
+			Constants:    vm.constants,
+			NumGlobals:   vm.numGlobals,
+		})
+		if err != nil {
+			return err
+		}
+		vm.verified = true
+	}
+
+	err := vm.run(ctx)
+	for err != nil && vm.handleException(err) {
+		err = vm.run(ctx)
+	}
+	if exit, ok := err.(*object.Exit); ok {
+		// exit()不是错误,原样返回退出码
+		return exit
+	}
+	if err != nil {
+		return vm.newRuntimeError(err)
+	}
+	return nil
+}
+
+func (vm *VM) run(ctx context.Context) error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
+	done := ctx.Done()
+
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		vm.instructions++
+		if vm.limits.MaxInstructions > 0 && vm.instructions > vm.limits.MaxInstructions {
+			return ErrInstructionLimit
+		}
+		// 不可取消的context(如Background)的done为nil,不需要检查
+		if done != nil && vm.instructions%cancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
+			}
+		}
+
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
@@ -346,7 +720,8 @@ func (vm *VM) Run() error {
 				return err
 			}
 		// 四则运算
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -363,7 +738,8 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+			code.OpGreaterThanOrEqual, code.OpLessThanOrEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -400,12 +776,18 @@ func (vm *VM) Run() error {
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
-			vm.globals[globalIndex] = vm.pop()
+			vm.globals.Set(int(globalIndex), vm.pop())
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[globalIndex])
+			val := vm.globals.Get(int(globalIndex))
+			// 尚未赋值的全局绑定,例如let x = x + 1
+			if val == nil {
+				val = Null
+			}
+
+			err := vm.push(val)
 			if err != nil {
 				return err
 			}
@@ -413,6 +795,9 @@ func (vm *VM) Run() error {
 			numElements := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
 
+			if err := vm.allocate(); err != nil {
+				return err
+			}
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
 
@@ -425,6 +810,9 @@ func (vm *VM) Run() error {
 			numElements := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
 
+			if err := vm.allocate(); err != nil {
+				return err
+			}
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
 				return err
@@ -445,6 +833,43 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetIndex:
+			val := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeSetIndex(left, index, val)
+			if err != nil {
+				return err
+			}
+		case code.OpDup2:
+			err := vm.push(vm.stack[vm.sp-2])
+			if err != nil {
+				return err
+			}
+			err = vm.push(vm.stack[vm.sp-2])
+			if err != nil {
+				return err
+			}
+		case code.OpLoadModule:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.loadModule(int(constIndex))
+			if err != nil {
+				return err
+			}
+		case code.OpTry:
+			target := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			frame := vm.currentFrame()
+			frame.handlers = append(frame.handlers, handler{target: int(target), sp: vm.sp})
+		case code.OpEndTry:
+			frame := vm.currentFrame()
+			frame.handlers = frame.handlers[:len(frame.handlers)-1]
+		case code.OpThrow:
+			return &thrownError{value: vm.pop()}
 		case code.OpCall:
 			numArgs := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
@@ -453,10 +878,24 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
 		case code.OpReturnValue:
 			// 弹出返回值
 			returnValue := vm.pop()
 
+			// 主程序中的return结束执行,返回值作为最后弹出的值(与求值器一致)
+			if vm.framesIndex == 1 {
+				vm.currentFrame().ip = len(ins) - 1
+				return nil
+			}
+
 			frame := vm.popFrame()
 			// basePointer指向 函数call之后 local指令之前 的地址
 			vm.sp = frame.basePointer - 1
@@ -481,24 +920,41 @@ func (vm *VM) Run() error {
 			frame := vm.currentFrame()
 
 			// 将栈顶值弹出并保存到 指定偏移量(basePointer+int(localIndex)) 的位置
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+			// 已被闭包捕获的局部绑定存放的是Cell,写入Cell内部
+			slot := frame.basePointer + int(localIndex)
+			if cell, ok := vm.stack[slot].(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				vm.stack[slot] = vm.pop()
+			}
 		case code.OpGetLocal:
 			localIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
 			frame := vm.currentFrame()
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			val := vm.stack[frame.basePointer+int(localIndex)]
+			if cell, ok := val.(*object.Cell); ok {
+				val = cell.Value
+			}
+			// 尚未赋值的局部绑定
+			if val == nil {
+				val = Null
+			}
+
+			err := vm.push(val)
 			if err != nil {
 				return err
 			}
-		// case code.OpFor:
 		case code.OpGetBuiltin:
 			builtinIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
-			definition := object.Builtins[builtinIndex]
-			err := vm.push(definition.Builtin)
+			builtin := vm.registry.Get(int(builtinIndex))
+			if builtin == nil {
+				return fmt.Errorf("unknown builtin index %d", builtinIndex)
+			}
+			err := vm.push(builtin)
 			if err != nil {
 				return err
 			}
@@ -514,6 +970,45 @@ func (vm *VM) Run() error {
 		case code.OpGetFree:
 			freeIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
+			currentClosure := vm.currentFrame().cl
+			val := currentClosure.Free[freeIndex].Value
+			if val == nil {
+				val = Null
+			}
+
+			err := vm.push(val)
+			if err != nil {
+				return err
+			}
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			currentClosure.Free[freeIndex].Value = vm.pop()
+		case code.OpCaptureLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			// 第一次被捕获时把局部绑定装箱,之后外层函数和闭包共享同一个Cell
+			slot := vm.currentFrame().basePointer + int(localIndex)
+			cell, ok := vm.stack[slot].(*object.Cell)
+			if !ok {
+				if err := vm.allocate(); err != nil {
+					return err
+				}
+				cell = &object.Cell{Value: vm.stack[slot]}
+				vm.stack[slot] = cell
+			}
+
+			err := vm.push(cell)
+			if err != nil {
+				return err
+			}
+		case code.OpCaptureFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure.Free[freeIndex])
 			if err != nil {
@@ -538,23 +1033,49 @@ func (vm *VM) pushClosure(constIndex int, numFree int) error {
 		return fmt.Errorf("not a function: %+v", constant)
 	}
 
-	free := make([]object.Object, numFree)
+	free := make([]*object.Cell, numFree)
 	for i := 0; i < numFree; i++ {
-		free[i] = vm.stack[vm.sp-numFree+i]
+		// 捕获的函数自身(OpCurrentClosure)不会被修改,直接包一层Cell
+		val := vm.stack[vm.sp-numFree+i]
+		cell, ok := val.(*object.Cell)
+		if !ok {
+			cell = &object.Cell{Value: val}
+		}
+		free[i] = cell
 	}
 	// 清理栈
 	vm.sp = vm.sp - numFree
 
+	if err := vm.allocate(); err != nil {
+		return err
+	}
 	closure := &object.Closure{Fn: function, Free: free}
 	return vm.push(closure)
 }
 
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	// 权限在调用时检查,之前保存的内置函数也不能绕过限制
+	if err := vm.registry.Authorize(builtin); err != nil {
+		return err
+	}
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 
 	result := builtin.Fn(args...)
 	vm.sp = vm.sp - numArgs - 1
 
+	switch result := result.(type) {
+	case *object.Exit:
+		return result
+	case *object.Error:
+		// 与求值器一致,内置函数返回的错误是运行时错误,可以被try捕获
+		return errors.New(result.Message)
+	}
+	switch result.(type) {
+	case *object.Array, *object.Hash, *object.String:
+		if err := vm.allocate(); err != nil {
+			return err
+		}
+	}
 	if result != nil {
 		vm.push(result)
 	} else {
@@ -567,18 +1088,32 @@ func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	if numArgs != cl.Fn.NumParameters {
 		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
 	}
+	// 局部变量之后至少留一个槽位给返回值等操作数
+	err := vm.growStack(vm.sp - numArgs + cl.Fn.NumLocals + 1)
+	if err != nil {
+		return err
+	}
 	// 进入函数栈帧
 	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	err = vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
 
 	vm.sp = frame.basePointer + cl.Fn.NumLocals
+	// 清空上一次调用残留的局部绑定,避免写入旧的Cell
+	for i := frame.basePointer + numArgs; i < vm.sp; i++ {
+		vm.stack[i] = nil
+	}
 	return nil
 }
 
 // 元素压栈
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	if vm.sp >= len(vm.stack) {
+		if err := vm.growStack(vm.sp + 1); err != nil {
+			return err
+		}
 	}
 
 	vm.stack[vm.sp] = o
@@ -594,14 +1129,45 @@ func (vm *VM) pop() object.Object {
 	return o
 }
 
+// 保证栈至少有n个槽位,超过limits.MaxStack时栈溢出
+func (vm *VM) growStack(n int) error {
+	if n <= len(vm.stack) {
+		return nil
+	}
+	if n > vm.limits.MaxStack {
+		return vm.stackOverflow()
+	}
+	stack := make([]object.Object, growSize(len(vm.stack), n, vm.limits.MaxStack))
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
+}
+
+// 容量按倍数增长,至少为n,不超过max
+func growSize(size, n, max int) int {
+	size *= 2
+	if size < n {
+		size = n
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
 // 仅用于测试
 func (vm *VM) LastPoppedStackElem() object.Object {
+	if vm.sp >= len(vm.stack) {
+		return nil
+	}
 	return vm.stack[vm.sp]
 }
 
 // repl中创建新编译器并保留旧字节码和全局存储
-func NewWithState(bytecode *compiler.Bytecode, s []object.Object) *VM {
+// 多次执行共享同一个globals,槽位不够时会增长
+func NewWithState(bytecode *compiler.Bytecode, globals *Globals) *VM {
 	vm := New(bytecode)
-	vm.globals = s
+	globals.grow(bytecode.NumGlobals)
+	vm.globals = globals
 	return vm
 }
@@ -1,13 +1,22 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"malang/ast"
+	"malang/code"
 	"malang/compiler"
 	"malang/lexer"
+	"malang/module"
+	"malang/module/moduletest"
 	"malang/object"
 	"malang/parser"
+	"math"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func parse(input string) *ast.Program {
@@ -42,46 +51,79 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	res, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if res.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", res.Value, expected)
+	}
+
+	return nil
+}
+
 type vmTestCase struct {
 	input    string
 	expected interface{}
 }
 
+// 每个用例分别在开启和关闭编译器优化时执行,结果必须相同
 func runVmTests(t *testing.T, ts []vmTestCase) {
 	t.Helper()
 
 	for _, tt := range ts {
-		program := parse(tt.input)
+		runVmTest(t, tt, true)
+		runVmTest(t, tt, false)
+	}
+}
 
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			t.Fatalf("compiler error: %s", err)
-		}
+func runVmTest(t *testing.T, tt vmTestCase, optimize bool) {
+	t.Helper()
 
-		for i, constant := range comp.Bytecode().Constants {
-			fmt.Printf("CONSTANT %d %p (%T):\n", i, constant, constant)
+	program := parse(tt.input)
 
-			switch constant := constant.(type) {
-			case *object.CompiledFunction:
-				fmt.Printf(" Instructions:\n%s", constant.Instructions)
-			case *object.Integer:
-				fmt.Printf(" Value: %d\n", constant.Value)
-			}
+	comp := compiler.New()
+	comp.SetOptimize(optimize)
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
 
-			fmt.Printf("\n")
-		}
+	for i, constant := range comp.Bytecode().Constants {
+		fmt.Printf("CONSTANT %d %p (%T):\n", i, constant, constant)
 
-		vm := New(comp.Bytecode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
+		switch constant := constant.(type) {
+		case *object.CompiledFunction:
+			fmt.Printf(" Instructions:\n%s", constant.Instructions)
+		case *object.Integer:
+			fmt.Printf(" Value: %d\n", constant.Value)
 		}
 
-		stackElem := vm.LastPoppedStackElem()
+		fmt.Printf("\n")
+	}
 
-		testExpectedObject(t, tt.expected, stackElem)
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	// 内置函数返回的错误是运行时错误
+	if expected, ok := tt.expected.(*object.Error); ok {
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("%s (optimize=%t): expected *RuntimeError, got %T (%v)", tt.input, optimize, err, err)
+		}
+		if rtErr.Err.Error() != expected.Message {
+			t.Errorf("wrong error message. expected=%q, got=%q", expected.Message, rtErr.Err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("vm error (optimize=%t): %s", optimize, err)
 	}
+
+	stackElem := vm.LastPoppedStackElem()
+
+	testExpectedObject(t, tt.expected, stackElem)
 }
 
 func testStringObject(expected string, actual object.Object) error {
@@ -110,6 +152,11 @@ func testExpectedObject(
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case bool:
 		err := testBooleanObject(bool(expected), actual)
 		if err != nil {
@@ -165,15 +212,6 @@ func testExpectedObject(
 				t.Errorf("testIntegerObject failed: %s", err)
 			}
 		}
-	case *object.Error:
-		errObj, ok := actual.(*object.Error)
-		if !ok {
-			t.Errorf("object is not Error: %T (%+v)", actual, actual)
-			return
-		}
-		if errObj.Message != expected.Message {
-			t.Errorf("wrong error message. expected=%q, got=%q", expected.Message, errObj.Message)
-		}
 	}
 }
 
@@ -245,6 +283,12 @@ func TestConditionals(t *testing.T) {
 		{"if (1 > 2) { 10 }", Null},
 		{"if (false) { 10 }", Null},
 		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		{"if (true) { let a = 1 }", Null},
+		{"if (false) { 10 } else { let b = 2 }", Null},
+		{"if (true) { }", Null},
+		{"if (false) { 10 } else { }", Null},
+		{"let f = fn(x) { if (x) { let a = 1 } else { 2 } }; f(true)", Null},
+		{"let f = fn(x) { if (x) { let a = 1 } else { 2 } }; f(false)", 2},
 	}
 
 	runVmTests(t, ts)
@@ -257,6 +301,9 @@ func TestGlobalLetStatements(t *testing.T) {
 		{"let one = 1; let two = one + one; one + two", 3},
 		{"let one = 1; let two = one + one; let three = one + two; three", 3},
 		// {"let one = 1; let two = one + one; let one = one + two; one", 3},
+		// 初始化之前读取全局变量得到null
+		{"let x = x; x", Null},
+		{"let x = x + 1; x", &object.Error{Message: "unsupported types for binary operation: NULL INTEGER"}},
 	}
 
 	runVmTests(t, ts)
@@ -317,6 +364,11 @@ func TestIndexExpressions(t *testing.T) {
 		{"{1: 1, 2: 2}[1]", 1},
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
+		// 整数值的浮点数与相等的整数是同一个键
+		{`{1: "a"}[1.0]`, "a"},
+		{`{2.0: "b"}[2]`, "b"},
+		{`{1.5: "c"}[1.5]`, "c"},
+		{`{1: "a"}[1.5]`, Null},
 		{"{}[0]", Null},
 		{`"hello"[0]`, "h"},
 	}
@@ -544,15 +596,15 @@ func TestCallingFunctionWithWrongArguments(t *testing.T) {
 	ts := []vmTestCase{
 		{
 			input:    `fn() { 1; }(1);`,
-			expected: `wrong number of arguments: want=0, got=1`,
+			expected: `1:1: wrong number of arguments: want=0, got=1`,
 		},
 		{
 			input:    `fn(a) { a; }();`,
-			expected: `wrong number of arguments: want=1, got=0`,
+			expected: `1:1: wrong number of arguments: want=1, got=0`,
 		},
 		{
 			input:    `fn(a, b) { a + b; }(1);`,
-			expected: `wrong number of arguments: want=2, got=1`,
+			expected: `1:1: wrong number of arguments: want=2, got=1`,
 		},
 	}
 
@@ -772,3 +824,1021 @@ func TestRecursiveFibonacci(t *testing.T) {
 
 	runVmTests(t, ts)
 }
+
+func TestForLoops(t *testing.T) {
+	ts := []vmTestCase{
+		{"for (false) { 1 }", Null},
+		{"let i = 0; for (i < 5) { let i = i + 1; }; i", 5},
+		{"let i = 0; for (true) { let i = i + 1; if (i > 3) { break; } }; i", 4},
+		{
+			input: `
+			let i = 0;
+			let sum = 0;
+			for (i < 10) {
+				let i = i + 1;
+				if (i > 5) { continue; }
+				let sum = sum + i;
+			};
+			sum
+			`,
+			expected: 15,
+		},
+		{
+			input: `
+			let f = fn() {
+				let i = 0;
+				for (true) {
+					let i = i + 1;
+					if (i == 3) { return i * 10; }
+				}
+			};
+			f()
+			`,
+			expected: 30,
+		},
+		{
+			input: `
+			let count = 0;
+			let i = 0;
+			for (i < 3) {
+				let i = i + 1;
+				let j = 0;
+				for (true) {
+					let j = j + 1;
+					if (j > 2) { break; }
+					let count = count + 1;
+				}
+			};
+			count
+			`,
+			expected: 6,
+		},
+	}
+
+	runVmTests(t, ts)
+}
+
+func TestBreakInExpression(t *testing.T) {
+	ts := []vmTestCase{
+		{"let i = 0; for (i < 3) { i += 1; let x = 1 + if (i == 2) { break } else { 2 } }; i", 2},
+		{"let n = 0; let i = 0; for (i < 5) { i += 1; let a = [1, 2, if (i % 2 == 0) { continue } else { 3 }]; n += len(a) }; n", 9},
+		{"let f = fn(x) { let i = 0; for (true) { i += 1; x + if (i > 2) { break } else { 0 } }; i }; f(1)", 3},
+		{"let i = 0; for (i < 3) { i += 1; 1 + try { if (i == 2) { break }; 1 } finally { 0 } }; i", 2},
+		{"let i = 0; for (true) { i += 1; let x = i && if (i == 3) { break } else { true } }; i", 3},
+	}
+
+	runVmTests(t, ts)
+
+	// 每次跳出都不会在栈上留下操作数
+	input := "let i = 0; for (i < 40000) { i += 1; let a = [1, 2, if (true) { continue } else { 3 }] }; i"
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if vm.sp != 0 {
+		t.Errorf("operands left on the stack. sp=%d", vm.sp)
+	}
+	testExpectedObject(t, 40000, vm.LastPoppedStackElem())
+}
+
+func TestLogicalExpressions(t *testing.T) {
+	ts := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || true", true},
+		{"true || false", true},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"1 && \"a\"", true},
+		{"if (false) { 1 } || 0", true},
+		{"true || false && false", true},
+		// 短路:右侧不会被执行,否则会产生运行时错误
+		{"false && (1 + true)", false},
+		{"true || (1 + true)", true},
+		{"if (1 > 2 || 3 > 2) { 10 } else { 20 }", 10},
+	}
+
+	runVmTests(t, ts)
+}
+
+func TestRuntimeErrorStackTrace(t *testing.T) {
+	// wrapper中的调用不是尾调用,否则wrapper的栈帧会被复用
+	input := `let add = fn(a, b) {
+	a + b
+};
+let wrapper = fn() {
+	add(1, true) + 0
+};
+wrapper();`
+
+	l := lexer.NewWithFile("test.mal", input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+	}
+
+	expectedError := "test.mal:2:2: unsupported types for binary operation: INTEGER BOOLEAN"
+	if rtErr.Error() != expectedError {
+		t.Errorf("wrong error. want=%q, got=%q", expectedError, rtErr.Error())
+	}
+
+	expectedStack := []string{
+		"add (test.mal:2:2)",
+		"wrapper (test.mal:5:2)",
+		"<main> (test.mal:7:1)",
+	}
+	if len(rtErr.Stack) != len(expectedStack) {
+		t.Fatalf("wrong stack depth. want=%d, got=%d (%+v)", len(expectedStack), len(rtErr.Stack), rtErr.Stack)
+	}
+	for i, frame := range rtErr.Stack {
+		if frame.String() != expectedStack[i] {
+			t.Errorf("stack[%d] wrong. want=%q, got=%q", i, expectedStack[i], frame.String())
+		}
+	}
+
+	expectedTrace := "stack trace:\n" +
+		"\tat add (test.mal:2:2)\n" +
+		"\tat wrapper (test.mal:5:2)\n" +
+		"\tat <main> (test.mal:7:1)\n"
+	if rtErr.StackTrace() != expectedTrace {
+		t.Errorf("wrong stack trace. want=%q, got=%q", expectedTrace, rtErr.StackTrace())
+	}
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	ts := []vmTestCase{
+		{"3.14", 3.14},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"1 - 0.25", 0.75},
+		{"1e-3 * 1000", 1.0},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"2 == 2.0", true},
+		{"2.5 != 2.5", false},
+		{"float(3)", 3.0},
+		{"int(3.9)", 3},
+		{`float("2.25")`, 2.25},
+		{"let avg = fn(a, b) { (a + b) / 2.0 }; avg(1, 2)", 1.5},
+	}
+
+	runVmTests(t, ts)
+}
+
+// 返回开启优化时的错误,关闭优化时的错误必须与之相同
+func runVmErrorTest(t *testing.T, input string, policy OverflowPolicy) error {
+	t.Helper()
+
+	var errs [2]error
+	for i, optimize := range []bool{true, false} {
+		comp := compiler.New()
+		comp.SetOptimize(optimize)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetOverflowPolicy(policy)
+		errs[i] = vm.Run()
+	}
+
+	if fmt.Sprint(errs[0]) != fmt.Sprint(errs[1]) {
+		t.Errorf("%s: optimized and unoptimized errors differ: %v, %v", input, errs[0], errs[1])
+	}
+	return errs[0]
+}
+
+func TestDivisionByZero(t *testing.T) {
+	ts := []string{
+		"1 / 0",
+		"let zero = 0; 10 / zero",
+		"let f = fn(a, b) { a / b }; f(1, 0)",
+	}
+
+	for _, input := range ts {
+		err := runVmErrorTest(t, input, OverflowWrap)
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", input)
+		}
+
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+		}
+		if rtErr.Message != "division by zero" {
+			t.Errorf("wrong VM error for %q. want=%q, got=%q", input, "division by zero", rtErr.Message)
+		}
+	}
+
+	// 浮点数除以0不是错误
+	runVmTests(t, []vmTestCase{{"1.0 / 0 > 1e308", true}})
+}
+
+func TestIntegerOverflowPolicy(t *testing.T) {
+	ts := []struct {
+		input         string
+		wrapped       int64
+		expectedError string
+	}{
+		{"9223372036854775807 + 1", math.MinInt64, "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", math.MaxInt64, "integer overflow: -9223372036854775807 - 2"},
+		{"4611686018427387904 * 2", math.MinInt64, "integer overflow: 4611686018427387904 * 2"},
+		{"let min = -9223372036854775807 - 1; min / -1", math.MinInt64, "integer overflow: -9223372036854775808 / -1"},
+		{"let min = -9223372036854775807 - 1; -min", math.MinInt64, "integer overflow: -(-9223372036854775808)"},
+	}
+
+	for _, tt := range ts {
+		// 默认回绕
+		runVmTests(t, []vmTestCase{{tt.input, int(tt.wrapped)}})
+
+		err := runVmErrorTest(t, tt.input, OverflowError)
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+		if rtErr := err.(*RuntimeError); rtErr.Message != tt.expectedError {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expectedError, rtErr.Message)
+		}
+	}
+
+	// 不溢出的运算在两种策略下结果相同
+	err := runVmErrorTest(t, "9223372036854775806 + 1; -9223372036854775807 - 1; 3037000499 * 3037000499", OverflowError)
+	if err != nil {
+		t.Fatalf("unexpected VM error: %s", err)
+	}
+}
+
+func TestOperatorSuite(t *testing.T) {
+	ts := []vmTestCase{
+		{"7 % 3", 7 % 3},
+		{"-7 % 3", -7 % 3},
+		{"7.5 % 2", 1.5},
+		{"6 & 3", 6 & 3},
+		{"6 | 3", 6 | 3},
+		{"6 ^ 3", 6 ^ 3},
+		{"1 << 10", 1 << 10},
+		{"1024 >> 3", 1024 >> 3},
+		{"-8 >> 1", -8 >> 1},
+		{"1 + 6 & 3", 1 + 6&3},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"2.5 >= 2", true},
+		{"1.5 <= 1", false},
+		{"10 % 4 == 2 && 1 <= 1", true},
+		{"let i = 0; let evens = 0; for (i < 10) { if (i % 2 == 0) { let evens = evens + 1 }; let i = i + 1 }; evens", 5},
+	}
+
+	runVmTests(t, ts)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 % 0", "modulo by zero"},
+		{"1 << -1", "negative shift count: -1"},
+		{"1.5 & 1", "unknown operator: FLOAT & INTEGER"},
+		{"1 << 2.0", "unknown operator: INTEGER << FLOAT"},
+		{`"a" % "b"`, "unknown operator: STRING % STRING"},
+		{`"a" < "b"`, "unknown operator: STRING < STRING"},
+		{"true > false", "unknown operator: BOOLEAN > BOOLEAN"},
+		{`1 < "a"`, "type mismatch: INTEGER < STRING"},
+	}
+	for _, tt := range errorTests {
+		err := runVmErrorTest(t, tt.input, OverflowWrap)
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+		if rtErr := err.(*RuntimeError); rtErr.Message != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expected, rtErr.Message)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	ts := []vmTestCase{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 10; x += 5; x", 15},
+		{"let x = 10; x -= 5; x", 5},
+		{"let x = 10; x *= 5; x", 50},
+		{"let x = 10; x /= 5; x", 2},
+		{"let x = 1.5; x += 1; x", 2.5},
+		{"let a = 0; let b = 0; a = b = 7; a + b", 14},
+		{"let i = 0; for (i < 5) { i += 1 }; i", 5},
+		{"let f = fn() { let a = 1; a += 2; a }; f()", 3},
+		// 函数内修改外层变量
+		{"let x = 1; let f = fn() { x = x + 1 }; f(); f(); x", 3},
+		{"let x = 1; let f = fn(x) { x = 10 }; f(5); x", 1},
+		// 函数名绑定是只读的,给它赋值会修改外层的同名变量
+		{"let f = fn() { f = 1 }; f(); f", 1},
+		{"let g = fn() { let f = fn() { f = 2 }; f(); f }; g()", 2},
+		// 闭包与外层函数共享被捕获的变量
+		{`
+let newCounter = fn() {
+	let count = 0;
+	fn() { count += 1 }
+};
+let counterA = newCounter();
+let counterB = newCounter();
+counterA(); counterA(); counterB();
+counterA() * 10 + counterB()`, 32},
+		{`
+let f = fn() {
+	let x = 1;
+	let get = fn() { x };
+	x = 5;
+	get()
+};
+f()`, 5},
+		{`
+let f = fn() {
+	let x = 1;
+	let inc = fn() { fn() { x += 1 } };
+	let g = inc();
+	g(); g();
+	x
+};
+f()`, 3},
+		{`
+let pair = fn() {
+	let n = 0;
+	[fn() { n += 1 }, fn() { n }]
+};
+let p = pair();
+p[0](); p[0](); p[0]();
+p[1]()`, 3},
+		// 被捕获的参数
+		{"let adder = fn(n) { fn() { n += 1 } }; let a = adder(10); a(); a()", 12},
+		// 每次调用得到新的局部绑定,不会复用上次调用的Cell
+		{`
+let mk = fn() { let v = 0; fn() { v += 1 } };
+let a = mk(); a(); a();
+let b = mk();
+b()`, 1},
+	}
+
+	runVmTests(t, ts)
+}
+
+func TestIndexAssignExpressions(t *testing.T) {
+	ts := []vmTestCase{
+		{"let a = [1, 2, 3]; a[0] = 10; a[0]", 10},
+		{"let a = [1, 2, 3]; a[2] = 5", 5},
+		{"let a = [1, 2, 3]; a[1] += 5; a", []int{1, 7, 3}},
+		{"let a = [[1, 2], [3, 4]]; a[1][0] *= 10; a[1][0]", 30},
+		{`let h = {"a": 1}; h["a"] = 2; h["a"]`, 2},
+		{`let h = {}; h["b"] = 3; h["b"]`, 3},
+		{`let h = {"n": 1}; h["n"] -= 3; h["n"]`, -2},
+		{`let h = {1: 1}; h[2] = 4; h`, map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey(): 1,
+			(&object.Integer{Value: 2}).HashKey(): 4,
+		}},
+		{"let a = [0]; let f = fn(arr) { arr[0] = 9 }; f(a); a[0]", 9},
+		{"let a = [0, 0, 0]; let i = 0; for (i < 3) { a[i] = i * i; i += 1 }; a", []int{0, 1, 4}},
+		// 函数内局部数组
+		{"let f = fn() { let a = [1, 2]; a[1] += a[0]; a[1] }; f()", 3},
+		// 数组字面量每次求值都是新数组
+		{"let f = fn() { let a = [0]; a[0] += 1; a[0] }; f(); f()", 1},
+	}
+
+	runVmTests(t, ts)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [1]; a[1] = 2", "index out of range: 1 (length 1)"},
+		{"let a = [1]; a[-1] = 2", "index out of range: -1 (length 1)"},
+		{`let a = [1]; a["x"] = 2`, "array index must be INTEGER, got STRING"},
+		{`let h = {}; h[fn() {}] = 1`, "unusable as hash key: CLOSURE_OBJ"},
+		{`let s = "abc"; s[0] = "x"`, "index assignment not supported: STRING"},
+	}
+	for _, tt := range errorTests {
+		err := runVmErrorTest(t, tt.input, OverflowWrap)
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+		if rtErr := err.(*RuntimeError); rtErr.Message != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expected, rtErr.Message)
+		}
+	}
+}
+
+// 在临时目录中写入模块文件,返回目录路径
+func TestUseExpression(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"main.mal":       "",
+		"mathx.mal":      "let secret = 2;\nexport let double = fn(x) { x * secret };\nexport let two = secret;",
+		"counter.mal":    "let count = 0;\nexport let inc = fn() { count += 1 };\nexport let get = fn() { count };",
+		"live.mal":       "export let n = 0;\nexport let bump = fn() { n += 1 };",
+		"sub/helper.mal": "use leaf;\nexport let helper = fn() { leaf.value + 1 };",
+		"sub/leaf.mal":   "export let value = 41;",
+		"cyclea.mal":     "use cycleb;",
+		"cycleb.mal":     "use cyclea;",
+		"usesfn.mal":     "export let f = fn() { use mathx as m; m.double(5) };",
+		"boom.mal":       "export let boom = fn() {\n\t1 / 0\n};",
+		"legacy.mal":     "puts(1);",
+	})
+
+	compileUse := func(input string) (*compiler.Bytecode, error) {
+		l := lexer.NewWithFile(filepath.Join(dir, "main.mal"), input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+
+		comp := compiler.New()
+		comp.SetModuleLoader(module.NewLoader([]string{filepath.Join(dir, "sub")}))
+		err := comp.Compile(program)
+		if err != nil {
+			return nil, err
+		}
+		return comp.Bytecode(), nil
+	}
+
+	ts := []vmTestCase{
+		{"use mathx; mathx.double(21)", 42},
+		{"use mathx as m; m.double(21)", 42},
+		{`use mathx; mathx["two"]`, 2},
+		// 模块有独立的命名空间,同名绑定互不覆盖
+		{"let double = 1; use mathx; double + mathx.double(1)", 3},
+		{"let secret = 5; use mathx; mathx.double(1) + secret", 7},
+		// 模块只执行一次,两个别名指向同一个模块
+		{"use counter as a; use counter as b; a.inc(); b.inc(); a.get()", 2},
+		// 模块内部修改导出的变量,外部读到的是当前值
+		{"use live; live.bump(); live.bump(); live.n", 2},
+		{`use live; live.bump(); live["n"]`, 1},
+		// helper在搜索路径中,它导入的leaf相对于helper所在目录解析
+		{"use helper; helper.helper()", 42},
+		{"use usesfn; usesfn.f()", 10},
+		// 模块对象可以作为值传递
+		{`use mathx as m; let g = fn(mod) { mod["double"](4) }; g(m)`, 8},
+		{"let h = {\"a\": 1}; h.a = h.a + 1; h.a", 2},
+		{"use legacy", nil},
+	}
+
+	for _, tt := range ts {
+		bytecode, err := compileUse(tt.input)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if tt.expected == nil {
+			if _, ok := vm.LastPoppedStackElem().(*object.Module); !ok {
+				t.Errorf("use did not return a module. got=%T", vm.LastPoppedStackElem())
+			}
+			continue
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+
+	// 同一模块只编译一次
+	bytecode, _ := compileUse("use mathx; use mathx as m; use helper; use leaf")
+	modules := 0
+	for _, c := range bytecode.Constants {
+		if _, ok := c.(*object.CompiledModule); ok {
+			modules++
+		}
+	}
+	if modules != 3 {
+		t.Errorf("wrong number of compiled modules. want=3, got=%d", modules)
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"use nope", "main.mal:1:1: module not found: nope.mal"},
+		{"use cyclea", "cycleb.mal:1:1: import cycle: "},
+		{"use mathx; secret", "main.mal:1:12: undefined variable secret"},
+		// 编译期检查模块成员
+		{"use mathx;\nmathx.secret", "main.mal:2:7: module mathx has no exported member secret"},
+		{`use mathx as m; let f = fn() { m["nope"] }`, "main.mal:1:34: module mathx has no exported member nope"},
+	}
+
+	for _, tt := range errorTests {
+		_, err := compileUse(tt.input)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but resulted in none.", tt.input)
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong compiler error. want %q in %q", tt.expected, err)
+		}
+	}
+
+	// 名字被重新赋值后不再按模块检查
+	bytecode, err := compileUse(`use mathx as m; m = {"nope": 1}; m.nope`)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 1, vm.LastPoppedStackElem())
+
+	// 运行时错误的调用栈包含模块中的函数
+	bytecode, err = compileUse("use boom;\nboom.boom()")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err = New(bytecode).Run()
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected *RuntimeError, got=%T (%v)", err, err)
+	}
+	want := filepath.Join(dir, "boom.mal") + ":2:2: division by zero"
+	if rtErr.Error() != want {
+		t.Errorf("wrong error. want=%q, got=%q", want, rtErr.Error())
+	}
+	if len(rtErr.Stack) != 2 || rtErr.Stack[1].Function != "<main>" {
+		t.Errorf("wrong stack trace:\n%s", rtErr.StackTrace())
+	}
+}
+
+func TestScriptBuiltins(t *testing.T) {
+	t.Setenv("MALANG_TEST_VAR", "hello")
+
+	// 命令行参数随注册表传入,没有设置时为空数组
+	r := object.NewRegistry()
+	r.SetArgs([]string{"in.txt", "-v"})
+	args := []vmTestCase{
+		{`len(args())`, 2},
+		{`args()[0]`, "in.txt"},
+		{`args()[1]`, "-v"},
+	}
+	for _, tt := range args {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode())
+		vm.SetRegistry(r)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+
+	ts := []vmTestCase{
+		{`len(args())`, 0},
+		{`getenv("MALANG_TEST_VAR")`, "hello"},
+		{`getenv("MALANG_TEST_UNSET_VAR")`, Null},
+		{
+			`exit("a")`,
+			&object.Error{Message: "argument to `exit` must be INTEGER. got STRING"},
+		},
+	}
+
+	runVmTests(t, ts)
+}
+
+func TestExit(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected int
+	}{
+		{`exit(); 1`, 0},
+		{`exit(3); 1`, 3},
+		{`let f = fn(n) { if (n > 2) { exit(n) }; n }; let i = 0; for (i < 10) { f(i); i += 1 }; 99`, 3},
+		{`let f = fn() { exit(4) }; [1, f(), 2]`, 4},
+	}
+
+	for _, tt := range ts {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		exit, ok := err.(*object.Exit)
+		if !ok {
+			t.Errorf("%s: expected *object.Exit, got=%T (%v)", tt.input, err, err)
+			continue
+		}
+		if exit.Code != tt.expected {
+			t.Errorf("%s: wrong exit code. want=%d, got=%d", tt.input, tt.expected, exit.Code)
+		}
+	}
+}
+
+func TestFileBuiltins(t *testing.T) {
+	dir := moduletest.WriteModules(t, map[string]string{
+		"lines.txt": "a\nb\n",
+	})
+	path := filepath.Join(dir, "lines.txt")
+	out := filepath.Join(dir, "out.txt")
+
+	ts := []vmTestCase{
+		{fmt.Sprintf(`len(read_lines(%q))`, path), 2},
+		{fmt.Sprintf(`read_file(%q)`, path), "a\nb\n"},
+		{fmt.Sprintf(`exists(%q) == true`, path), true},
+		{fmt.Sprintf(`write_file(%q, "x"); append_file(%q, "y"); read_file(%q)`, out, out, out), "xy"},
+		{fmt.Sprintf(`write_file(%q, "x"); remove(%q); exists(%q)`, out, out, out), false},
+		{
+			fmt.Sprintf(`read_file(%q)`, out),
+			&object.Error{Message: "read_file: open " + out + ": no such file or directory"},
+		},
+	}
+
+	runVmTests(t, ts)
+}
+
+func TestRegistryBuiltins(t *testing.T) {
+	r := object.NewRegistry()
+	r.Register("double", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+
+	comp := compiler.New()
+	comp.SetRegistry(r)
+	err := comp.Compile(parse(`let f = fn(x) { double(x) + len([1]) }; f(20)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetRegistry(r)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 41, vm.LastPoppedStackElem())
+
+	// 执行时没有对应的内置函数
+	vm = New(comp.Bytecode())
+	err = vm.Run()
+	expectedErr := fmt.Sprintf("1:17: unknown builtin index %d", len(object.Builtins))
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("expected unknown builtin error, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ts := []struct {
+		input       string
+		limits      Limits
+		expectedErr error
+	}{
+		{`let i = 0; for (true) { i += 1 }`, Limits{MaxInstructions: 1000}, ErrInstructionLimit},
+		{`let f = fn(n) { 1 + f(n + 1) }; f(0)`, Limits{}, ErrStackOverflow},
+		{`let f = fn(n) { if (n > 0) { 1 + f(n - 1) } else { 0 } }; f(100)`, Limits{MaxFrames: 50}, ErrStackOverflow},
+		{`[1, 2, 3, 4, 5, 6, 7, 8]`, Limits{MaxStack: 4}, ErrStackOverflow},
+		{`let a = []; for (true) { a = push(a, 1) }`, Limits{MaxObjects: 100}, ErrObjectLimit},
+		{`let s = ""; for (true) { s += "x" }`, Limits{MaxObjects: 100}, ErrObjectLimit},
+		{`for (true) { fn() { 1 } }`, Limits{MaxObjects: 100}, ErrObjectLimit},
+		// 限制足够时正常执行
+		{`let f = fn(n) { if (n > 0) { f(n - 1) } else { [n] } }; f(100)`, Limits{MaxInstructions: 10000, MaxObjects: 200}, nil},
+	}
+
+	for _, tt := range ts {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(tt.limits)
+		err = vm.Run()
+		if tt.expectedErr == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.input, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.expectedErr) {
+			t.Errorf("%s: want error %q, got %v", tt.input, tt.expectedErr, err)
+			continue
+		}
+		if _, ok := err.(*RuntimeError); !ok {
+			t.Errorf("%s: error is not *RuntimeError. got=%T", tt.input, err)
+		}
+	}
+}
+
+func TestGrowableStack(t *testing.T) {
+	elements := make([]string, 3000)
+	for i := range elements {
+		elements[i] = "1"
+	}
+
+	// 超过初始容量和原来固定大小的栈
+	runVmTests(t, []vmTestCase{
+		{`let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(10000)`, 50005000},
+		{"len([" + strings.Join(elements, ", ") + "])", 3000},
+		{`let f = fn(n) { 1 + f(n + 1) }; try { f(0) } catch (e) { e }`, "stack overflow (call depth 16384)"},
+	})
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(n) { if (n > 0) { 1 + f(n - 1) } else { 0 } }; f(100)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetLimits(Limits{MaxFrames: 50})
+	err = vm.Run()
+	var overflow *StackOverflowError
+	if !errors.As(err, &overflow) || overflow.Depth != 50 {
+		t.Fatalf("want stack overflow at depth 50, got %v", err)
+	}
+	if !strings.HasSuffix(err.Error(), "stack overflow (call depth 50)") {
+		t.Errorf("wrong error message: %q", err)
+	}
+}
+
+func TestGlobalsSize(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let a = 1; let b = fn() { let c = a; c }; b()`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+	if bytecode.NumGlobals != 2 {
+		t.Fatalf("wrong NumGlobals. want=2, got=%d", bytecode.NumGlobals)
+	}
+	if vm := New(bytecode); vm.globals.Len() != 2 {
+		t.Errorf("wrong number of global slots. want=2, got=%d", vm.globals.Len())
+	}
+
+	// 多次执行共享同一个Globals,新定义的全局变量使槽位增长
+	globals := NewGlobals()
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(object.NewRegistry())
+	constants := []object.Object{}
+	inputs := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let a = 1;`, nil},
+		{`let b = a + 1; let c = b + 1;`, nil},
+		{`a + b + c`, 6},
+	}
+	for _, tt := range inputs {
+		comp := compiler.NewWithState(symbolTable, constants)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		constants = bytecode.Constants
+
+		vm := NewWithState(bytecode, globals)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		if globals.Len() < bytecode.NumGlobals {
+			t.Errorf("globals not grown. want>=%d, got=%d", bytecode.NumGlobals, globals.Len())
+		}
+		if tt.expected != nil {
+			testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+		}
+	}
+}
+
+func TestVerifyBeforeRun(t *testing.T) {
+	// 格式错误的字节码在执行前被拒绝,而不是让宿主程序崩溃
+	ts := []*compiler.Bytecode{
+		{Instructions: code.Make(code.OpConstant, 3)},
+		{Instructions: code.Make(code.OpPop)},
+		{Instructions: append(code.Make(code.OpJump, 1), code.Make(code.OpNull)...)},
+		{Instructions: code.Make(code.OpEndTry)},
+		{Instructions: append(code.Make(code.OpGetGlobal, 1), code.Make(code.OpPop)...), NumGlobals: 1},
+	}
+
+	for _, bytecode := range ts {
+		vm := New(bytecode)
+		err := vm.Run()
+		if _, ok := err.(*compiler.VerifyError); !ok {
+			t.Errorf("%q: expected *compiler.VerifyError, got %T (%v)", bytecode.Instructions, err, err)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let i = 0; for (true) { i += 1 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	vm := New(comp.Bytecode())
+	err = vm.RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T", err)
+	}
+	if rtErr.Stack[0].Function != "<main>" {
+		t.Errorf("wrong stack trace: %s", rtErr.StackTrace())
+	}
+}
+
+func TestRestrictedRegistry(t *testing.T) {
+	// 用完整的注册表编译,在受限的注册表下执行
+	comp := compiler.New()
+	err := comp.Compile(parse(`let log = fn(x) { puts(x) }; len("ok"); log(1)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetRegistry(object.NewRegistry().Restrict())
+	err = vm.Run()
+
+	var permErr *object.PermissionError
+	if !errors.As(err, &permErr) {
+		t.Fatalf("want *object.PermissionError, got %T (%v)", err, err)
+	}
+	if permErr.Builtin != "puts" || permErr.Capability != object.CapIO {
+		t.Errorf("wrong permission error: %+v", permErr)
+	}
+	if err.Error() != "1:19: permission denied: puts requires the io capability" {
+		t.Errorf("wrong error message: %s", err)
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	ts := []struct {
+		input    string
+		expected string // 结果的Inspect()或错误信息
+	}{
+		{`try { 1 } catch (e) { 2 }`, "1"},
+		{`try { throw 1; 2 } catch (e) { e + 10 }`, "11"},
+		{`try { throw "x" } catch { 2 }`, "2"},
+		{`try { 1 / 0 } catch (e) { e }`, "division by zero"},
+		{`let f = fn(x) { if (x > 2) { throw [x] }; x }; try { f(1) + f(5) } catch (e) { e }`, "[5]"},
+		{`let n = 0; try { n = 1 } finally { n = n + 1 }; n`, "2"},
+		{`let n = 0; let r = try { throw 1 } catch (e) { n = 1; 5 } finally { n = n + 1 }; [r, n]`, "[5, 2]"},
+		{`let n = 0; let f = fn() { try { return 1 } finally { n = 2 } }; [f(), n]`, "[1, 2]"},
+		{`let f = fn() { try { return 1 } finally { return 2 } }; f()`, "2"},
+		{`let n = 0; let i = 0; for (i < 5) { i += 1; try { if (i == 3) { break } } finally { n += 1 } }; [i, n]`, "[3, 3]"},
+		{`try { try { throw 1 } finally { 2 } } catch (e) { e }`, "1"},
+		{`try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e }`, "2"},
+		{`try { } catch (e) { 1 }`, "null"},
+		// 处理器恢复的是登记时的栈,外层表达式的操作数不受影响
+		{`let t = fn() { throw 4 }; 1 + try { [2, 3, t()] } catch (e) { e }`, "5"},
+		{`let f = fn(n) { if (n == 0) { throw "bottom" }; f(n - 1) }; let g = fn() { try { f(50) } catch (e) { e } }; g() + "!"`, "bottom!"},
+		{`let i = 0; let n = 0; for (i < 3) { i += 1; try { if (i == 2) { continue }; n += 1 } catch { 0 } }; n`, "2"},
+		{`throw {"a": 1}`, "1:1: uncaught exception: {a: 1}"},
+		{`try { 1 } finally { throw 2 }`, "1:21: uncaught exception: 2"},
+		{`let f = fn() { throw 1 }; f()`, "1:16: uncaught exception: 1"},
+		// 内置函数的错误可以被捕获
+		{`try { read_file("/nonexistent/x") } catch (e) { "caught" }`, "caught"},
+		{`try { len(1, 2) } catch (e) { e }`, "wrong number of arguments. got=2, want=1"},
+	}
+
+	for _, tt := range ts {
+		for _, optimize := range []bool{true, false} {
+			comp := compiler.New()
+			comp.SetOptimize(optimize)
+			err := comp.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(comp.Bytecode())
+			err = vm.Run()
+			actual := ""
+			if err != nil {
+				actual = err.Error()
+			} else {
+				actual = vm.LastPoppedStackElem().Inspect()
+			}
+			if actual != tt.expected {
+				t.Errorf("%s (optimize=%t): want=%q, got=%q", tt.input, optimize, tt.expected, actual)
+			}
+		}
+	}
+
+	// exit()和执行限制不能被捕获
+	err := runVmErrorTest(t, `try { exit(3) } catch (e) { 1 }`, OverflowWrap)
+	if exit, ok := err.(*object.Exit); !ok || exit.Code != 3 {
+		t.Errorf("expected exit(3), got=%T (%v)", err, err)
+	}
+
+	// exit()立即结束程序,不执行finally(与求值器一致)
+	exits := []string{
+		`let n = 0; try { exit(3) } catch (e) { 1 } finally { n = 1 }`,
+		`let n = 0; try { throw 1 } catch (e) { exit(3) } finally { n = 1 }`,
+	}
+	for _, input := range exits {
+		comp := compiler.New()
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if exit, ok := err.(*object.Exit); !ok || exit.Code != 3 {
+			t.Errorf("%s: expected exit(3), got=%T (%v)", input, err, err)
+		}
+		if n := vm.globals.Get(0); n.Inspect() != "0" {
+			t.Errorf("%s: finally ran on exit", input)
+		}
+	}
+
+	comp := compiler.New()
+	err = comp.Compile(parse(`try { for (true) { } } catch (e) { 1 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	vm.SetLimits(Limits{MaxInstructions: 100})
+	err = vm.Run()
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Errorf("expected ErrInstructionLimit, got=%v", err)
+	}
+}
+
+func TestTopLevelReturn(t *testing.T) {
+	ts := []vmTestCase{
+		{`1; return 2; 3`, 2},
+		{`let x = 5; if (x > 2) { return x * 2 }; 0`, 10},
+		{`let n = 0; try { return 1 } finally { n = 2 }`, 1},
+		{`let f = fn() { return 1 }; return f() + 1`, 2},
+	}
+
+	runVmTests(t, ts)
+}
+
+func TestTailCalls(t *testing.T) {
+	ts := []vmTestCase{
+		{`let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + n) } }; f(100000, 0)`, 5000050000},
+		{`let f = fn(n) { if (n == 0) { return "done" }; return f(n - 1) }; f(100000)`, "done"},
+		{`let odd = 0; let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; even(100001)`, false},
+		{`let f = fn(n) { if (n == 0) { len("abc") } else { f(n - 1) } }; f(10)`, 3},
+		// 与std.mal中的map相同,元素个数超过MaxFrames
+		{`
+		let map = fn(arr, f) {
+			let iter = fn(arr, accumulated) {
+				if (len(arr) == 0) { accumulated } else { iter(rest(arr), push(accumulated, f(first(arr)))) }
+			};
+			iter(arr, []);
+		};
+		let make = fn(n, arr) { if (n == 0) { arr } else { make(n - 1, push(arr, n)) } };
+		len(map(make(2000, []), fn(x) { x * 2 }))
+		`, 2000},
+		// 复用栈帧不影响已经被闭包捕获的参数
+		{`let f = fn(n, fs) { if (n == 0) { fs } else { let g = fn() { n }; f(n - 1, push(fs, g)) } }; let fs = f(3, []); [fs[0](), fs[1](), fs[2]()]`, []int{3, 2, 1}},
+		// try中的调用不是尾调用
+		{`let f = fn(n) { try { if (n == 0) { throw "bottom" } else { f(n - 1) } } catch (e) { e } }; f(10)`, "bottom"},
+	}
+
+	runVmTests(t, ts)
+
+	// 尾递归不受MaxFrames限制
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(1000)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	vm.SetLimits(Limits{MaxFrames: 4})
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 0, vm.LastPoppedStackElem())
+
+	err = runVmErrorTest(t, `let f = fn(a) { a }; let g = fn() { f(1, 2) }; g()`, OverflowWrap)
+	if err == nil || err.Error() != "1:37: wrong number of arguments: want=1, got=2" {
+		t.Errorf("wrong error: %v", err)
+	}
+}